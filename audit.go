@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// auditMaxPages caps how many pages of new audit events a single scrape reads.
+const auditMaxPages = 20
+
+// defaultAuditActions are the action patterns counted by name when
+// BITBUCKET_AUDIT_ACTIONS is unset; every other action is counted as "other".
+var defaultAuditActions = []string{"*permission*", "repository deleted", "*token created", "*settings changed"}
+
+// auditEvent is the subset of an Atlassian audit event the exporter reads.
+type auditEvent struct {
+	Timestamp string `json:"timestamp"`
+	Type      struct {
+		Category string `json:"category"`
+		Action   string `json:"action"`
+	} `json:"type"`
+}
+
+// auditCursor is the persisted position in the audit log. Events arrive
+// newest first, so a walk cut short by the page cap or a failed page leaves
+// older events unread: they are kept as a gap, (Last, GapEnd], that later
+// polls fill before reading anything newer than Newest.
+type auditCursor struct {
+	Last   time.Time  `json:"last"`              // every event up to here has been counted
+	GapEnd *time.Time `json:"gap_end,omitempty"` // newest unread event of the gap, nil when there is none
+	Newest time.Time  `json:"newest"`            // newest event counted, while there is a gap
+}
+
+// timedEvent is an audit event with its parsed timestamp.
+type timedEvent struct {
+	auditEvent
+	ts time.Time
+}
+
+// AuditCollector tails the Data Center audit log and counts sensitive
+// administrative actions. The cursor is persisted to cursorFile, if set, so a
+// restart neither recounts nor skips events; without a cursor counting starts
+// at the current time.
+type AuditCollector struct {
+	client     *BitbucketClient
+	logLevel   string
+	cursorFile string
+	actions    []string // lower-case glob patterns of actions counted by name
+
+	mu             sync.Mutex
+	cursor         auditCursor
+	lastByCategory map[string]time.Time // newest event counted per category
+
+	eventsTotal   *prometheus.CounterVec
+	lastEventTime *prometheus.GaugeVec
+}
+
+func NewAuditCollector(client *BitbucketClient, cursorFile string, actions []string, logLevel string) *AuditCollector {
+	if len(actions) == 0 {
+		actions = defaultAuditActions
+	}
+	c := &AuditCollector{
+		client:         client,
+		logLevel:       logLevel,
+		cursorFile:     cursorFile,
+		lastByCategory: make(map[string]time.Time),
+		eventsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_audit_events_total",
+			Help: "Audit events by category and action (Data Center); actions outside the allowlist are counted as other",
+		}, []string{"category", "action"}),
+		lastEventTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bitbucket_audit_last_event_timestamp",
+			Help: "Unix timestamp of the newest audit event per category (Data Center)",
+		}, []string{"category"}),
+	}
+	for _, a := range actions {
+		c.actions = append(c.actions, strings.ToLower(a))
+	}
+	c.cursor = c.loadCursor()
+	return c
+}
+
+func (c *AuditCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.eventsTotal.Describe(ch)
+	c.lastEventTime.Describe(ch)
+}
+
+func (c *AuditCollector) Collect(ch chan<- prometheus.Metric) {
+	// The audit REST API is a Data Center feature.
+	if !c.client.Cloud {
+		c.mu.Lock()
+		c.poll()
+		c.mu.Unlock()
+	}
+	c.eventsTotal.Collect(ch)
+	c.lastEventTime.Collect(ch)
+}
+
+// loadCursor reads the persisted cursor, starting from now when there is none.
+func (c *AuditCollector) loadCursor() auditCursor {
+	cursor := auditCursor{Last: time.Now().UTC()}
+	if c.cursorFile == "" {
+		return cursor
+	}
+	data, err := os.ReadFile(c.cursorFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return cursor
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		log.Printf("error reading audit cursor %s, starting from now: %v", c.cursorFile, err)
+	}
+	return cursor
+}
+
+// saveCursor persists the cursor, replacing the file atomically.
+func (c *AuditCollector) saveCursor() {
+	if c.cursorFile == "" {
+		return
+	}
+	data, _ := json.Marshal(c.cursor)
+	tmp := c.cursorFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("error writing audit cursor: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.cursorFile); err != nil {
+		log.Printf("error writing audit cursor: %v", err)
+	}
+}
+
+// poll counts the events of the gap, if there is one, or else the events
+// newer than the cursor, and advances the cursor past what was counted.
+func (c *AuditCollector) poll() {
+	var to time.Time
+	if c.cursor.GapEnd != nil {
+		to = *c.cursor.GapEnd
+	}
+	events, complete := c.walk(c.cursor.Last, to)
+	if len(events) == 0 && (!complete || c.cursor.GapEnd == nil) {
+		return
+	}
+
+	// A cut-short walk holds back the events at its oldest timestamp, as
+	// unread events can share it; they are read again with the gap.
+	var cut time.Time
+	if !complete {
+		cut = events[0].ts
+		for _, e := range events {
+			if e.ts.Before(cut) {
+				cut = e.ts
+			}
+		}
+	}
+	newest := c.cursor.Last
+	if c.cursor.GapEnd != nil {
+		newest = c.cursor.Newest
+	}
+	for _, e := range events {
+		if !complete && !e.ts.After(cut) {
+			continue
+		}
+		c.eventsTotal.WithLabelValues(e.Type.Category, c.actionLabel(e.Type.Action)).Inc()
+		if e.ts.After(c.lastByCategory[e.Type.Category]) {
+			c.lastByCategory[e.Type.Category] = e.ts
+			c.lastEventTime.WithLabelValues(e.Type.Category).Set(float64(e.ts.Unix()))
+		}
+		if e.ts.After(newest) {
+			newest = e.ts
+		}
+	}
+
+	if complete {
+		c.cursor = auditCursor{Last: newest}
+	} else {
+		c.cursor.GapEnd, c.cursor.Newest = &cut, newest
+		debugf(c.logLevel, "Audit log walk stopped early, events up to %s are read on the next scrape", cut.Format(time.RFC3339Nano))
+	}
+	c.saveCursor()
+}
+
+// walk reads the events after from and, unless to is zero, up to and
+// including to, newest first. complete is false when the walk stopped at the
+// page cap or on a failed page, so older events remain unread.
+func (c *AuditCollector) walk(from, to time.Time) (events []timedEvent, complete bool) {
+	base := c.client.BaseURL + "/rest/auditing/1.0/events?limit=200&from=" + url.QueryEscape(from.Format(time.RFC3339Nano))
+	if !to.IsZero() {
+		base += "&to=" + url.QueryEscape(to.Format(time.RFC3339Nano))
+	}
+	next := base
+	for page := 0; page < auditMaxPages; page++ {
+		var data struct {
+			Entities   []auditEvent `json:"entities"`
+			PagingInfo struct {
+				NextPageCursor string `json:"nextPageCursor"`
+			} `json:"pagingInfo"`
+		}
+		if err := c.client.getJSON(next, &data); err != nil {
+			debugf(c.logLevel, "Failed to fetch audit events: %v", err)
+			return events, false
+		}
+		for _, e := range data.Entities {
+			ts, err := time.Parse(time.RFC3339Nano, e.Timestamp)
+			if err != nil || !ts.After(from) || (!to.IsZero() && ts.After(to)) {
+				continue
+			}
+			events = append(events, timedEvent{e, ts})
+		}
+		if data.PagingInfo.NextPageCursor == "" {
+			return events, true
+		}
+		next = base + "&cursor=" + url.QueryEscape(data.PagingInfo.NextPageCursor)
+	}
+	return events, false
+}
+
+// actionLabel returns the action if it matches the allowlist, otherwise "other".
+func (c *AuditCollector) actionLabel(action string) string {
+	lower := strings.ToLower(action)
+	for _, p := range c.actions {
+		if ok, _ := path.Match(p, lower); ok {
+			return action
+		}
+	}
+	return "other"
+}
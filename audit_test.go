@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditCollector_CountsOnceAndPersistsCursor(t *testing.T) {
+	start := time.Now().UTC()
+	event := func(offset time.Duration, category, action string) map[string]interface{} {
+		return map[string]interface{}{
+			"timestamp": start.Add(offset).Format(time.RFC3339Nano),
+			"type":      map[string]string{"category": category, "action": action},
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"entities": []interface{}{
+			event(3*time.Second, "Permissions", "Repository permission granted"),
+			event(2*time.Second, "Repositories", "Repository deleted"),
+			event(time.Second, "Repositories", "Repository created"),
+			event(-time.Hour, "Permissions", "Global permission changed"),
+		}})
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+	cursorFile := filepath.Join(t.TempDir(), "audit.json")
+
+	c := NewAuditCollector(client, cursorFile, nil, "info")
+	c.cursor.Last = start
+	scrape(t, c)
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_audit_events_total{action="Repository permission granted",category="Permissions"} 1`,
+		`bitbucket_audit_events_total{action="Repository deleted",category="Repositories"} 1`,
+		`bitbucket_audit_events_total{action="other",category="Repositories"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Global permission changed") {
+		t.Errorf("event before the cursor was counted")
+	}
+
+	restarted := NewAuditCollector(client, cursorFile, nil, "info")
+	if !restarted.cursor.Last.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("persisted cursor = %v, want %v", restarted.cursor.Last, start.Add(3*time.Second))
+	}
+}
+
+// auditLog serves n events, one per page and newest first, one second apart
+// after start, honouring from and to. failPage, if set, fails once when reached.
+func auditLog(t *testing.T, start time.Time, n int, failPage *int) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		from, _ := time.Parse(time.RFC3339Nano, q.Get("from"))
+		to, _ := time.Parse(time.RFC3339Nano, q.Get("to"))
+		var matching []time.Time
+		for i := n; i >= 1; i-- {
+			at := start.Add(time.Duration(i) * time.Second)
+			if at.After(from) && (to.IsZero() || !at.After(to)) {
+				matching = append(matching, at)
+			}
+		}
+		pos, _ := strconv.Atoi(q.Get("cursor"))
+		if failPage != nil && *failPage == pos {
+			*failPage = -1
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body := map[string]interface{}{"entities": []interface{}{}}
+		if pos < len(matching) {
+			body["entities"] = []interface{}{map[string]interface{}{
+				"timestamp": matching[pos].Format(time.RFC3339Nano),
+				"type":      map[string]string{"category": "Repositories", "action": "Repository deleted"},
+			}}
+		}
+		if pos+1 < len(matching) {
+			body["pagingInfo"] = map[string]string{"nextPageCursor": strconv.Itoa(pos + 1)}
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestAuditCollector_PageCapLeavesNoGap(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	total := auditMaxPages + 5
+	ts := auditLog(t, start, total, nil)
+	c := NewAuditCollector(NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false), "", nil, "info")
+	c.cursor.Last = start
+
+	// The first scrape stops at the page cap; the next ones read the older events.
+	for i := 0; i < 3; i++ {
+		scrape(t, c)
+	}
+	out := scrape(t, c)
+	if want := fmt.Sprintf(`bitbucket_audit_events_total{action="Repository deleted",category="Repositories"} %d`, total); !strings.Contains(out, want) {
+		t.Errorf("scrape missing %q\n%s", want, out)
+	}
+	if c.cursor.GapEnd != nil || !c.cursor.Last.Equal(start.Add(time.Duration(total)*time.Second)) {
+		t.Errorf("cursor = %+v, want every event read", c.cursor)
+	}
+}
+
+func TestAuditCollector_FailedPageLeavesNoGap(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	failPage := 3
+	ts := auditLog(t, start, 8, &failPage)
+	cursorFile := filepath.Join(t.TempDir(), "audit.json")
+	c := NewAuditCollector(NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false), cursorFile, nil, "info")
+	c.cursor.Last = start
+
+	scrape(t, c)
+	if c.cursor.GapEnd == nil {
+		t.Fatalf("a walk that failed mid-way must leave a gap, cursor = %+v", c.cursor)
+	}
+	// The gap survives a restart.
+	c.cursor = NewAuditCollector(c.client, cursorFile, nil, "info").cursor
+	out := scrape(t, c)
+	if want := `bitbucket_audit_events_total{action="Repository deleted",category="Repositories"} 8`; !strings.Contains(out, want) {
+		t.Errorf("scrape missing %q\n%s", want, out)
+	}
+	if want := fmt.Sprintf(`bitbucket_audit_last_event_timestamp{category="Repositories"} %g`, float64(start.Add(8*time.Second).Unix())); !strings.Contains(out, want) {
+		t.Errorf("filling the gap moved the last event timestamp back: missing %q\n%s", want, out)
+	}
+}
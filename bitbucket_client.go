@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type BitbucketClient struct {
@@ -13,6 +18,10 @@ type BitbucketClient struct {
 	Password  string
 	Cloud     bool
 	Workspace string // for Bitbucket Cloud
+
+	repoMu       sync.Mutex
+	repoCache    []Repository
+	repoCachedAt time.Time
 }
 
 func NewBitbucketClient(cfg *Config, cloud bool) *BitbucketClient {
@@ -339,3 +348,309 @@ func (c *BitbucketClient) GetRepoCommitStats() (map[string]int, map[string]map[s
 	}
 	return commitCounts, committers, nil
 }
+
+// cloudAPIURL is the Bitbucket Cloud REST API root. Tests point it at an httptest server.
+var cloudAPIURL = "https://api.bitbucket.org/2.0"
+
+// repoCacheTTL bounds how long the repository inventory is reused between collectors.
+// Every collector registered in main walks the same list, so a single scrape should only
+// enumerate the workspace once.
+const repoCacheTTL = 30 * time.Second
+
+// Repository identifies a repository on either Bitbucket Cloud or Data Center/Server.
+type Repository struct {
+	ProjectKey  string
+	ProjectName string
+	Slug        string
+	Name        string
+	UUID        string // stable across renames and moves: the Cloud uuid, the Data Center repository id
+	Archived    bool   // Data Center 8.0+ only
+}
+
+// getJSON performs an authenticated GET and decodes the JSON response into v.
+func (c *BitbucketClient) getJSON(url string, v interface{}) error {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth(c.Username, c.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statusError(resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return json.Unmarshal(body, v)
+}
+
+// exists performs an authenticated request and reports whether the resource
+// exists: true on 200 or 204, false on 404.
+func (c *BitbucketClient) exists(method, url string) (bool, error) {
+	req, _ := http.NewRequest(method, url, nil)
+	req.SetBasicAuth(c.Username, c.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, statusError(resp.StatusCode)
+}
+
+// statusError is a non-200 response status, comparable so callers can tell e.g. a missing endpoint apart.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status: %d", int(e))
+}
+
+// cloudPages follows the "next" links of a Bitbucket Cloud paged response and returns every value.
+func cloudPages[T any](c *BitbucketClient, url string) ([]T, error) {
+	var all []T
+	for url != "" {
+		var page struct {
+			Values []T    `json:"values"`
+			Next   string `json:"next"`
+		}
+		if err := c.getJSON(url, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Values...)
+		url = page.Next
+	}
+	return all, nil
+}
+
+// serverPages follows the start/isLastPage paging of the Data Center/Server REST API and returns every value.
+func serverPages[T any](c *BitbucketClient, url string) ([]T, error) {
+	var all []T
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	start := 0
+	for {
+		var page struct {
+			Values        []T  `json:"values"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}
+		if err := c.getJSON(fmt.Sprintf("%s%sstart=%d", url, sep, start), &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Values...)
+		if page.IsLastPage || len(page.Values) == 0 {
+			break
+		}
+		start = page.NextPageStart
+	}
+	return all, nil
+}
+
+// ListRepositories returns every repository visible to the configured credentials.
+// The result is cached for repoCacheTTL so that several collectors can share one enumeration.
+func (c *BitbucketClient) ListRepositories() ([]Repository, error) {
+	c.repoMu.Lock()
+	defer c.repoMu.Unlock()
+	if c.repoCache != nil && time.Since(c.repoCachedAt) < repoCacheTTL {
+		return c.repoCache, nil
+	}
+	var repos []Repository
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			UUID    string `json:"uuid"`
+			Slug    string `json:"slug"`
+			Name    string `json:"name"`
+			Project struct {
+				Key  string `json:"key"`
+				Name string `json:"name"`
+			} `json:"project"`
+		}](c, cloudAPIURL+"/repositories/"+c.Workspace+"?pagelen=100")
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range values {
+			if r.Project.Key == "" {
+				continue
+			}
+			repos = append(repos, Repository{r.Project.Key, r.Project.Name, r.Slug, r.Name, r.UUID, false})
+		}
+	} else {
+		values, err := serverPages[struct {
+			ID       int    `json:"id"`
+			Slug     string `json:"slug"`
+			Name     string `json:"name"`
+			Archived bool   `json:"archived"`
+			Project  struct {
+				Key  string `json:"key"`
+				Name string `json:"name"`
+			} `json:"project"`
+		}](c, c.BaseURL+"/rest/api/1.0/repos?limit=1000")
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range values {
+			repos = append(repos, Repository{r.Project.Key, r.Project.Name, r.Slug, r.Name, strconv.Itoa(r.ID), r.Archived})
+		}
+	}
+	c.repoCache = repos
+	c.repoCachedAt = time.Now()
+	return repos, nil
+}
+
+// PullRequest is a pull request on either flavor.
+type PullRequest struct {
+	ID           int
+	SourceBranch string
+	SourceCommit string
+	SourceRepo   string // full name of the repository the source branch lives in, e.g. a fork
+	Reviewers    int
+	AuthorID     string // account id on Cloud, user name on Data Center
+	CreatedOn    time.Time
+}
+
+// repoPath returns the REST root of a repository for the configured flavor.
+func (c *BitbucketClient) repoPath(repo Repository) string {
+	if c.Cloud {
+		return cloudAPIURL + "/repositories/" + c.Workspace + "/" + repo.Slug
+	}
+	return c.BaseURL + "/rest/api/1.0/projects/" + repo.ProjectKey + "/repos/" + repo.Slug
+}
+
+// DefaultBranch returns the name of a repository's default branch and the commit at its head.
+func (c *BitbucketClient) DefaultBranch(repo Repository) (string, string, error) {
+	if c.Cloud {
+		var info struct {
+			MainBranch struct {
+				Name string `json:"name"`
+			} `json:"mainbranch"`
+		}
+		if err := c.getJSON(c.repoPath(repo), &info); err != nil {
+			return "", "", err
+		}
+		if info.MainBranch.Name == "" {
+			return "", "", fmt.Errorf("repository %s has no main branch", repo.Slug)
+		}
+		var branch struct {
+			Target struct {
+				Hash string `json:"hash"`
+			} `json:"target"`
+		}
+		if err := c.getJSON(c.repoPath(repo)+"/refs/branches/"+url.PathEscape(info.MainBranch.Name), &branch); err != nil {
+			return "", "", err
+		}
+		return info.MainBranch.Name, branch.Target.Hash, nil
+	}
+	var ref struct {
+		ID        string `json:"id"`
+		DisplayID string `json:"displayId"`
+	}
+	if err := c.getJSON(c.repoPath(repo)+"/default-branch", &ref); err != nil {
+		return "", "", err
+	}
+	var commits struct {
+		Values []struct {
+			ID string `json:"id"`
+		} `json:"values"`
+	}
+	if err := c.getJSON(c.repoPath(repo)+"/commits?limit=1&until="+url.QueryEscape(ref.ID), &commits); err != nil {
+		return "", "", err
+	}
+	if len(commits.Values) == 0 {
+		return ref.DisplayID, "", nil
+	}
+	return ref.DisplayID, commits.Values[0].ID, nil
+}
+
+// OpenPullRequests lists the open pull requests of a repository.
+func (c *BitbucketClient) OpenPullRequests(repo Repository) ([]PullRequest, error) {
+	var prs []PullRequest
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			ID     int `json:"id"`
+			Source struct {
+				Branch struct {
+					Name string `json:"name"`
+				} `json:"branch"`
+				Commit struct {
+					Hash string `json:"hash"`
+				} `json:"commit"`
+				Repository struct {
+					FullName string `json:"full_name"`
+				} `json:"repository"`
+			} `json:"source"`
+			Reviewers []struct{} `json:"reviewers"`
+			Author    struct {
+				AccountID string `json:"account_id"`
+			} `json:"author"`
+			CreatedOn string `json:"created_on"`
+		}](c, c.repoPath(repo)+"/pullrequests?state=OPEN&pagelen=50&fields=%2Bvalues.reviewers")
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			created, _ := time.Parse(time.RFC3339, v.CreatedOn)
+			prs = append(prs, PullRequest{v.ID, v.Source.Branch.Name, v.Source.Commit.Hash, v.Source.Repository.FullName, len(v.Reviewers), v.Author.AccountID, created})
+		}
+		return prs, nil
+	}
+	values, err := serverPages[struct {
+		ID      int `json:"id"`
+		FromRef struct {
+			DisplayID    string `json:"displayId"`
+			LatestCommit string `json:"latestCommit"`
+			Repository   struct {
+				Slug    string `json:"slug"`
+				Project struct {
+					Key string `json:"key"`
+				} `json:"project"`
+			} `json:"repository"`
+		} `json:"fromRef"`
+		Reviewers []struct{} `json:"reviewers"`
+		Author    struct {
+			User struct {
+				Name string `json:"name"`
+			} `json:"user"`
+		} `json:"author"`
+		CreatedDate int64 `json:"createdDate"`
+	}](c, c.repoPath(repo)+"/pull-requests?state=OPEN&limit=100")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		prs = append(prs, PullRequest{v.ID, v.FromRef.DisplayID, v.FromRef.LatestCommit, v.FromRef.Repository.Project.Key + "/" + v.FromRef.Repository.Slug, len(v.Reviewers), v.Author.User.Name, time.UnixMilli(v.CreatedDate)})
+	}
+	return prs, nil
+}
+
+// ListProjectKeys returns the keys of every project visible to the configured credentials.
+func (c *BitbucketClient) ListProjectKeys() ([]string, error) {
+	var keys []string
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			Key string `json:"key"`
+		}](c, cloudAPIURL+"/workspaces/"+c.Workspace+"/projects?pagelen=100")
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			keys = append(keys, v.Key)
+		}
+		return keys, nil
+	}
+	values, err := serverPages[struct {
+		Key string `json:"key"`
+	}](c, c.BaseURL+"/rest/api/1.0/projects?limit=1000")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		keys = append(keys, v.Key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Rules of the required branch policy, see BITBUCKET_REQUIRED_BRANCH_POLICY.
+const (
+	ruleNoForcePush   = "no_force_push"
+	ruleNoDeletes     = "no_deletes"
+	ruleMinApprovals  = "min_approvals"
+	rulePassingBuilds = "passing_builds"
+	ruleMergeViaPR    = "merge_via_pr"
+)
+
+// defaultBranchPolicy is the required policy used when none is configured.
+const defaultBranchPolicy = "no_force_push,no_deletes,min_approvals=1,passing_builds=1,merge_via_pr"
+
+// restrictionRules maps a restriction kind to the boolean policy rules it
+// satisfies. Cloud kinds come first, Data Center branch permissions after.
+var restrictionRules = map[string][]string{
+	"force":             {ruleNoForcePush},
+	"delete":            {ruleNoDeletes},
+	"push":              {ruleMergeViaPR},
+	"read-only":         {ruleNoForcePush, ruleNoDeletes, ruleMergeViaPR},
+	"fast-forward-only": {ruleNoForcePush},
+	"no-deletes":        {ruleNoDeletes},
+	"pull-request-only": {ruleMergeViaPR},
+}
+
+// restrictionThresholds maps a restriction kind to the numeric policy rule its value counts towards.
+var restrictionThresholds = map[string]string{
+	"require_approvals_to_merge":      ruleMinApprovals,
+	"require_passing_builds_to_merge": rulePassingBuilds,
+}
+
+// parseBranchPolicy parses a comma-separated list of rules, numeric rules
+// taking their minimum as rule=N, into rule -> minimum.
+func parseBranchPolicy(s string) (map[string]int, error) {
+	policy := make(map[string]int)
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		rule, value, hasValue := strings.Cut(f, "=")
+		switch rule {
+		case ruleNoForcePush, ruleNoDeletes, ruleMergeViaPR:
+			if hasValue {
+				return nil, fmt.Errorf("rule %s takes no value", rule)
+			}
+			policy[rule] = 1
+		case ruleMinApprovals, rulePassingBuilds:
+			n := 1
+			if hasValue {
+				var err error
+				if n, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("rule %s: %v", rule, err)
+				}
+			}
+			policy[rule] = n
+		default:
+			return nil, fmt.Errorf("unknown branch policy rule %q", rule)
+		}
+	}
+	return policy, nil
+}
+
+// branchRestriction is a branch protection normalised across Cloud and Data Center.
+type branchRestriction struct {
+	Kind         string // force, delete, push, read-only, require_approvals_to_merge, ...
+	MatcherType  string // glob, branching_model on Cloud; BRANCH, PATTERN, MODEL_BRANCH, MODEL_CATEGORY, ANY_REF on Data Center
+	MatcherValue string // branch, pattern or branching model branch type
+	Value        int    // minimum for the require_* kinds
+	Inherited    bool   // configured on the Data Center project rather than the repository
+}
+
+// dcRefMatcher is how Data Center branch permissions and merge checks select branches.
+type dcRefMatcher struct {
+	ID        string `json:"id"`
+	DisplayID string `json:"displayId"`
+	Type      struct {
+		ID string `json:"id"`
+	} `json:"type"`
+}
+
+// restriction normalises a Data Center matcher into a branchRestriction of the given kind.
+func (m dcRefMatcher) restriction(kind string, value int, inherited bool) branchRestriction {
+	matcherValue := m.DisplayID
+	switch m.Type.ID {
+	case "MODEL_BRANCH", "MODEL_CATEGORY":
+		matcherValue = strings.ToLower(m.ID)
+	case "ANY_REF":
+		matcherValue = ""
+	}
+	return branchRestriction{kind, m.Type.ID, matcherValue, value, inherited}
+}
+
+// branchingModel is the development and production branch of a repository's
+// branching model and the prefixes of its branch types.
+type branchingModel struct {
+	Development string
+	Production  string
+	Prefixes    map[string]string // branch type -> prefix
+}
+
+// BranchRestrictions returns the branch protections configured on a repository.
+// On Data Center these are the branch permissions and required builds of the
+// repository and its project, plus the repository pull request settings,
+// which apply to every branch and are reported as require_* restrictions
+// matching ANY_REF.
+func (c *BitbucketClient) BranchRestrictions(repo Repository) ([]branchRestriction, error) {
+	var restrictions []branchRestriction
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			Kind            string `json:"kind"`
+			BranchMatchKind string `json:"branch_match_kind"`
+			Pattern         string `json:"pattern"`
+			BranchType      string `json:"branch_type"`
+			Value           *int   `json:"value"`
+		}](c, c.repoPath(repo)+"/branch-restrictions?pagelen=100")
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			r := branchRestriction{Kind: v.Kind, MatcherType: v.BranchMatchKind, MatcherValue: v.Pattern}
+			if v.BranchMatchKind == "branching_model" {
+				r.MatcherValue = v.BranchType
+			}
+			if v.Value != nil {
+				r.Value = *v.Value
+			}
+			restrictions = append(restrictions, r)
+		}
+		return restrictions, nil
+	}
+	var settings struct {
+		RequiredApprovers        int `json:"requiredApprovers"`
+		RequiredSuccessfulBuilds int `json:"requiredSuccessfulBuilds"`
+	}
+	if err := c.getJSON(c.repoPath(repo)+"/settings/pull-requests", &settings); err != nil {
+		return nil, err
+	}
+	anyRef := dcRefMatcher{}
+	anyRef.Type.ID = "ANY_REF"
+	if settings.RequiredApprovers > 0 {
+		restrictions = append(restrictions, anyRef.restriction("require_approvals_to_merge", settings.RequiredApprovers, false))
+	}
+	if settings.RequiredSuccessfulBuilds > 0 {
+		restrictions = append(restrictions, anyRef.restriction("require_passing_builds_to_merge", settings.RequiredSuccessfulBuilds, false))
+	}
+
+	project := "/projects/" + url.PathEscape(repo.ProjectKey)
+	scopes := []struct {
+		path      string
+		inherited bool
+	}{
+		{project + "/repos/" + url.PathEscape(repo.Slug), false},
+		{project, true},
+	}
+	for _, scope := range scopes {
+		permissions, err := serverPages[struct {
+			Type    string       `json:"type"`
+			Matcher dcRefMatcher `json:"matcher"`
+			Scope   struct {
+				Type string `json:"type"`
+			} `json:"scope"`
+		}](c, c.BaseURL+"/rest/branch-permissions/2.0"+scope.path+"/restrictions?limit=1000")
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range permissions {
+			// The repository endpoint can include project restrictions; they are read from the project itself.
+			if !scope.inherited && p.Scope.Type == "PROJECT" {
+				continue
+			}
+			restrictions = append(restrictions, p.Matcher.restriction(p.Type, 0, scope.inherited))
+		}
+		conditions, err := serverPages[struct {
+			BuildParentKeys []string     `json:"buildParentKeys"`
+			RefMatcher      dcRefMatcher `json:"refMatcher"`
+		}](c, c.BaseURL+"/rest/required-builds/latest"+scope.path+"/conditions?limit=1000")
+		if err != nil {
+			// Project level required builds need Data Center 8.x; older servers only know repository conditions.
+			if scope.inherited {
+				continue
+			}
+			return nil, err
+		}
+		for _, cond := range conditions {
+			restrictions = append(restrictions, cond.RefMatcher.restriction("require_passing_builds_to_merge", len(cond.BuildParentKeys), scope.inherited))
+		}
+	}
+	return restrictions, nil
+}
+
+// BranchingModel returns the branching model of a repository.
+func (c *BitbucketClient) BranchingModel(repo Repository) (branchingModel, error) {
+	model := branchingModel{Prefixes: make(map[string]string)}
+	if c.Cloud {
+		var data struct {
+			Development struct {
+				Branch struct {
+					Name string `json:"name"`
+				} `json:"branch"`
+			} `json:"development"`
+			Production *struct {
+				Branch struct {
+					Name string `json:"name"`
+				} `json:"branch"`
+			} `json:"production"`
+			BranchTypes []struct {
+				Kind   string `json:"kind"`
+				Prefix string `json:"prefix"`
+			} `json:"branch_types"`
+		}
+		if err := c.getJSON(c.repoPath(repo)+"/branching-model", &data); err != nil {
+			return model, err
+		}
+		model.Development = data.Development.Branch.Name
+		if data.Production != nil {
+			model.Production = data.Production.Branch.Name
+		}
+		for _, t := range data.BranchTypes {
+			model.Prefixes[t.Kind] = t.Prefix
+		}
+		return model, nil
+	}
+	var data struct {
+		Development *struct {
+			DisplayID string `json:"displayId"`
+		} `json:"development"`
+		Production *struct {
+			DisplayID string `json:"displayId"`
+		} `json:"production"`
+		Types []struct {
+			ID     string `json:"id"`
+			Prefix string `json:"prefix"`
+		} `json:"types"`
+	}
+	u := fmt.Sprintf("%s/rest/branch-utils/1.0/projects/%s/repos/%s/branchmodel", c.BaseURL, url.PathEscape(repo.ProjectKey), url.PathEscape(repo.Slug))
+	if err := c.getJSON(u, &data); err != nil {
+		return model, err
+	}
+	if data.Development != nil {
+		model.Development = data.Development.DisplayID
+	}
+	if data.Production != nil {
+		model.Production = data.Production.DisplayID
+	}
+	for _, t := range data.Types {
+		model.Prefixes[strings.ToLower(t.ID)] = t.Prefix
+	}
+	return model, nil
+}
+
+// appliesTo reports whether the restriction covers the named branch.
+func (r branchRestriction) appliesTo(branch string, model *branchingModel) bool {
+	switch r.MatcherType {
+	case "glob", "PATTERN":
+		return matchesAny([]string{r.MatcherValue}, branch)
+	case "BRANCH":
+		return r.MatcherValue == branch
+	case "ANY_REF":
+		return true
+	case "branching_model", "MODEL_BRANCH", "MODEL_CATEGORY":
+		if model == nil {
+			return false
+		}
+		switch r.MatcherValue {
+		case "development":
+			return model.Development == branch
+		case "production":
+			return model.Production == branch
+		}
+		prefix, ok := model.Prefixes[r.MatcherValue]
+		return ok && prefix != "" && strings.HasPrefix(branch, prefix)
+	}
+	return false
+}
+
+// usesBranchingModel reports whether the restriction matches branches through the branching model.
+func (r branchRestriction) usesBranchingModel() bool {
+	switch r.MatcherType {
+	case "branching_model", "MODEL_BRANCH", "MODEL_CATEGORY":
+		return true
+	}
+	return false
+}
+
+// evaluateBranchPolicy checks the restrictions that apply to a branch against
+// the required policy and returns the compliance of every required rule.
+func evaluateBranchPolicy(policy map[string]int, restrictions []branchRestriction) map[string]bool {
+	satisfied := make(map[string]bool)
+	values := make(map[string]int)
+	for _, r := range restrictions {
+		for _, rule := range restrictionRules[r.Kind] {
+			satisfied[rule] = true
+		}
+		if rule, ok := restrictionThresholds[r.Kind]; ok && r.Value > values[rule] {
+			values[rule] = r.Value
+		}
+	}
+	compliance := make(map[string]bool, len(policy))
+	for rule, min := range policy {
+		switch rule {
+		case ruleMinApprovals, rulePassingBuilds:
+			compliance[rule] = values[rule] >= min
+		default:
+			compliance[rule] = satisfied[rule]
+		}
+	}
+	return compliance
+}
+
+// branchPolicyMetrics reports the branch restrictions of a repo and whether
+// its default branch complies with the required branch policy.
+func (c *BitbucketCollector) branchPolicyMetrics(repo Repository, branch string) []prometheus.Metric {
+	restrictions, err := c.client.BranchRestrictions(repo)
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch branch restrictions for %s: %v", repo.Slug, err)
+		return nil
+	}
+	var metrics []prometheus.Metric
+	counts := make(map[[4]string]int)
+	for _, r := range restrictions {
+		counts[[4]string{r.Kind, r.MatcherType, r.MatcherValue, boolToString(r.Inherited)}]++
+	}
+	for k, n := range counts {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.branchRestrictionsTotal, prometheus.GaugeValue, float64(n), repo.ProjectKey, repo.Slug, k[0], k[1], k[2], k[3]))
+	}
+
+	if branch == "" {
+		return metrics
+	}
+	var model *branchingModel
+	var applicable []branchRestriction
+	for _, r := range restrictions {
+		if r.usesBranchingModel() && model == nil {
+			m, err := c.client.BranchingModel(repo)
+			if err != nil {
+				debugf(c.logLevel, "Failed to fetch branching model for %s: %v", repo.Slug, err)
+			}
+			model = &m
+		}
+		if r.appliesTo(branch, model) {
+			applicable = append(applicable, r)
+		}
+	}
+
+	compliance := evaluateBranchPolicy(c.requiredBranchPolicy, applicable)
+	rules := make([]string, 0, len(compliance))
+	for rule := range compliance {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	enforced := true
+	for _, rule := range rules {
+		enforced = enforced && compliance[rule]
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.branchPolicyRuleCompliant, prometheus.GaugeValue, boolToFloat(compliance[rule]), repo.ProjectKey, repo.Slug, branch, rule))
+	}
+	return append(metrics, prometheus.MustNewConstMetric(c.branchDefaultPolicyEnforced, prometheus.GaugeValue, boolToFloat(enforced), repo.ProjectKey, repo.Slug, branch))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestEvaluateBranchPolicy(t *testing.T) {
+	policy, err := parseBranchPolicy("no_force_push,no_deletes,min_approvals=2,passing_builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := &branchingModel{Development: "main", Prefixes: map[string]string{"release": "release/"}}
+	var applicable []branchRestriction
+	for _, r := range []branchRestriction{
+		{Kind: "force", MatcherType: "glob", MatcherValue: "ma*"},
+		{Kind: "delete", MatcherType: "branching_model", MatcherValue: "development"},
+		{Kind: "require_approvals_to_merge", MatcherType: "glob", MatcherValue: "*", Value: 1},
+		{Kind: "require_approvals_to_merge", MatcherType: "branching_model", MatcherValue: "release", Value: 3},
+		{Kind: "require_passing_builds_to_merge", MatcherType: "glob", MatcherValue: "develop", Value: 1},
+	} {
+		if r.appliesTo("main", model) {
+			applicable = append(applicable, r)
+		}
+	}
+	got := evaluateBranchPolicy(policy, applicable)
+	want := map[string]bool{ruleNoForcePush: true, ruleNoDeletes: true, ruleMinApprovals: false, rulePassingBuilds: false}
+	if len(got) != len(want) {
+		t.Fatalf("got rules %v, want %v", got, want)
+	}
+	for rule, ok := range want {
+		if got[rule] != ok {
+			t.Errorf("rule %s: got %v, want %v", rule, got[rule], ok)
+		}
+	}
+}
+
+func TestParseBranchPolicy_Errors(t *testing.T) {
+	for _, s := range []string{"no_force_push=1", "min_approvals=two", "signed_commits"} {
+		if _, err := parseBranchPolicy(s); err == nil {
+			t.Errorf("parseBranchPolicy(%q): expected error", s)
+		}
+	}
+}
+
+func TestDataCenterRestrictionMatching(t *testing.T) {
+	var dev, feature, exact dcRefMatcher
+	dev.ID, dev.Type.ID = "development", "MODEL_BRANCH"
+	feature.ID, feature.Type.ID = "FEATURE", "MODEL_CATEGORY"
+	exact.ID, exact.DisplayID, exact.Type.ID = "refs/heads/master", "master", "BRANCH"
+	model := &branchingModel{Development: "master", Prefixes: map[string]string{"feature": "feature/"}}
+
+	readOnly := dev.restriction("read-only", 0, true)
+	if !readOnly.appliesTo("master", model) || !readOnly.Inherited {
+		t.Errorf("inherited MODEL_BRANCH restriction should apply to the development branch: %+v", readOnly)
+	}
+	if r := feature.restriction("no-deletes", 0, false); r.appliesTo("master", model) || !r.appliesTo("feature/x", model) {
+		t.Errorf("MODEL_CATEGORY restriction should only apply to prefixed branches: %+v", r)
+	}
+	if r := exact.restriction("fast-forward-only", 0, false); !r.appliesTo("master", model) {
+		t.Errorf("BRANCH restriction should apply to its branch: %+v", r)
+	}
+
+	policy, _ := parseBranchPolicy("no_force_push,no_deletes,merge_via_pr")
+	for rule, ok := range evaluateBranchPolicy(policy, []branchRestriction{readOnly}) {
+		if !ok {
+			t.Errorf("read-only should satisfy %s", rule)
+		}
+	}
+}
+
+func TestBranchRestrictions_DataCenter(t *testing.T) {
+	matcher := func(typ, id, displayID string) map[string]interface{} {
+		return map[string]interface{}{"id": id, "displayId": displayID, "type": map[string]string{"id": typ}}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects/PRJ/repos/app/settings/pull-requests":
+			body = map[string]int{"requiredApprovers": 2, "requiredSuccessfulBuilds": 0}
+		case "/rest/branch-permissions/2.0/projects/PRJ/repos/app/restrictions":
+			body = page(
+				map[string]interface{}{"type": "fast-forward-only", "matcher": matcher("BRANCH", "refs/heads/master", "master"), "scope": map[string]string{"type": "REPOSITORY"}},
+				// Also listed by the project endpoint, so skipped here.
+				map[string]interface{}{"type": "no-deletes", "matcher": matcher("MODEL_BRANCH", "development", "Development"), "scope": map[string]string{"type": "PROJECT"}},
+			)
+		case "/rest/branch-permissions/2.0/projects/PRJ/restrictions":
+			body = page(map[string]interface{}{"type": "no-deletes", "matcher": matcher("MODEL_BRANCH", "development", "Development"), "scope": map[string]string{"type": "PROJECT"}})
+		case "/rest/required-builds/latest/projects/PRJ/repos/app/conditions":
+			body = page(map[string]interface{}{"buildParentKeys": []string{"ci", "lint"}, "refMatcher": matcher("PATTERN", "release/*", "release/*")})
+		default:
+			// Project level required builds are missing before Data Center 8.
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+
+	got, err := client.BranchRestrictions(Repository{ProjectKey: "PRJ", Slug: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []branchRestriction{
+		{"require_approvals_to_merge", "ANY_REF", "", 2, false},
+		{"fast-forward-only", "BRANCH", "master", 0, false},
+		{"require_passing_builds_to_merge", "PATTERN", "release/*", 2, false},
+		{"no-deletes", "MODEL_BRANCH", "development", 0, true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got restrictions\n%+v\nwant\n%+v", got, want)
+	}
+
+	model := &branchingModel{Development: "master"}
+	var applicable []branchRestriction
+	for _, r := range got {
+		if r.appliesTo("master", model) {
+			applicable = append(applicable, r)
+		}
+	}
+	policy, _ := parseBranchPolicy(defaultBranchPolicy)
+	compliance := evaluateBranchPolicy(policy, applicable)
+	for rule, ok := range map[string]bool{ruleNoForcePush: true, ruleNoDeletes: true, ruleMinApprovals: true, rulePassingBuilds: false, ruleMergeViaPR: false} {
+		if compliance[rule] != ok {
+			t.Errorf("rule %s: got %v, want %v", rule, compliance[rule], ok)
+		}
+	}
+}
+
+func TestBranchRestrictions_DataCenterRepoBuildsFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects/PRJ/repos/app/settings/pull-requests":
+			json.NewEncoder(w).Encode(map[string]int{})
+		case "/rest/branch-permissions/2.0/projects/PRJ/repos/app/restrictions":
+			json.NewEncoder(w).Encode(page())
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+
+	// Unlike the project conditions, repository required builds must be readable.
+	if _, err := client.BranchRestrictions(Repository{ProjectKey: "PRJ", Slug: "app"}); err == nil {
+		t.Errorf("expected an error when repository required builds fail")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dcLatestCommitMetadata is the Data Center branch metadata key holding the head commit details.
+const dcLatestCommitMetadata = "com.atlassian.bitbucket.server.bitbucket-branch:latest-commit-metadata"
+
+// maxCommitCountPages caps the pages walked when counting commits between two refs.
+const maxCommitCountPages = 50
+
+// Branch is a repository branch and the date of its head commit.
+type Branch struct {
+	Name       string
+	Head       string
+	CommitDate time.Time
+}
+
+// ListBranches returns every branch of a repository with its head commit date.
+func (c *BitbucketClient) ListBranches(repo Repository) ([]Branch, error) {
+	var branches []Branch
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			Name   string `json:"name"`
+			Target struct {
+				Hash string `json:"hash"`
+				Date string `json:"date"`
+			} `json:"target"`
+		}](c, c.repoPath(repo)+"/refs/branches?pagelen=100")
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			date, _ := time.Parse(time.RFC3339, v.Target.Date)
+			branches = append(branches, Branch{v.Name, v.Target.Hash, date})
+		}
+		return branches, nil
+	}
+	values, err := serverPages[struct {
+		DisplayID    string `json:"displayId"`
+		LatestCommit string `json:"latestCommit"`
+		Metadata     map[string]struct {
+			CommitterTimestamp int64 `json:"committerTimestamp"`
+		} `json:"metadata"`
+	}](c, c.repoPath(repo)+"/branches?details=true&limit=1000")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		var date time.Time
+		if meta, ok := v.Metadata[dcLatestCommitMetadata]; ok && meta.CommitterTimestamp > 0 {
+			date = time.UnixMilli(meta.CommitterTimestamp)
+		}
+		branches = append(branches, Branch{v.DisplayID, v.LatestCommit, date})
+	}
+	return branches, nil
+}
+
+// branchMetrics counts the branches of a repo, how many have gone stale for
+// each configured threshold and, if enabled, the ages of the oldest ones.
+// Branches whose head commit date is unknown are counted but never stale.
+func (c *BitbucketCollector) branchMetrics(repo Repository, defaultBranch string) []prometheus.Metric {
+	branches, err := c.client.ListBranches(repo)
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch branches for %s: %v", repo.Slug, err)
+		return nil
+	}
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(c.branchesTotal, prometheus.GaugeValue, float64(len(branches)), repo.ProjectKey, repo.Slug),
+	}
+
+	now := time.Now()
+	var dated []Branch
+	for _, b := range branches {
+		if !b.CommitDate.IsZero() {
+			dated = append(dated, b)
+		}
+	}
+	for _, days := range c.staleBranchDays {
+		cutoff := now.AddDate(0, 0, -days)
+		stale := 0
+		for _, b := range dated {
+			if b.CommitDate.Before(cutoff) {
+				stale++
+			}
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.staleBranches, prometheus.GaugeValue, float64(stale), repo.ProjectKey, repo.Slug, fmt.Sprintf("%dd", days)))
+	}
+
+	sort.Slice(dated, func(i, j int) bool { return dated[i].CommitDate.Before(dated[j].CommitDate) })
+	for i := 0; i < c.staleBranchTopN && i < len(dated); i++ {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.oldestBranchAge, prometheus.GaugeValue, now.Sub(dated[i].CommitDate).Seconds(), repo.ProjectKey, repo.Slug, dated[i].Name))
+	}
+	return append(metrics, c.branchDriftMetrics(repo, defaultBranch, branches)...)
+}
+
+// countCommits returns how many commits are reachable from include but not
+// from exclude, stopping at maxCommitCountPages pages.
+func (c *BitbucketClient) countCommits(repo Repository, include, exclude string) (int, error) {
+	count := 0
+	if c.Cloud {
+		next := c.repoPath(repo) + "/commits/" + url.PathEscape(include) + "?exclude=" + url.QueryEscape(exclude) + "&pagelen=100"
+		for page := 0; next != "" && page < maxCommitCountPages; page++ {
+			var data struct {
+				Values []struct{} `json:"values"`
+				Next   string     `json:"next"`
+			}
+			if err := c.getJSON(next, &data); err != nil {
+				return 0, err
+			}
+			count += len(data.Values)
+			next = data.Next
+		}
+		return count, nil
+	}
+	start := 0
+	for page := 0; page < maxCommitCountPages; page++ {
+		var data struct {
+			Size          int  `json:"size"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}
+		u := fmt.Sprintf("%s/compare/commits?from=%s&to=%s&limit=1000&start=%d", c.repoPath(repo), url.QueryEscape(include), url.QueryEscape(exclude), start)
+		if err := c.getJSON(u, &data); err != nil {
+			return 0, err
+		}
+		count += data.Size
+		if data.IsLastPage {
+			break
+		}
+		start = data.NextPageStart
+	}
+	return count, nil
+}
+
+// matchesAny reports whether name matches any of the glob patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// branchDriftMetrics reports how far each tracked branch has drifted from the
+// default branch base, in commits ahead and behind.
+func (c *BitbucketCollector) branchDriftMetrics(repo Repository, base string, branches []Branch) []prometheus.Metric {
+	if len(c.trackedBranches) == 0 || base == "" {
+		return nil
+	}
+	var metrics []prometheus.Metric
+	for _, b := range branches {
+		if b.Name == base || !matchesAny(c.trackedBranches, b.Name) {
+			continue
+		}
+		ahead, err := c.client.countCommits(repo, b.Name, base)
+		if err != nil {
+			debugf(c.logLevel, "Failed to compare %s with %s in %s: %v", b.Name, base, repo.Slug, err)
+			continue
+		}
+		behind, err := c.client.countCommits(repo, base, b.Name)
+		if err != nil {
+			debugf(c.logLevel, "Failed to compare %s with %s in %s: %v", base, b.Name, repo.Slug, err)
+			continue
+		}
+		metrics = append(metrics,
+			prometheus.MustNewConstMetric(c.branchAhead, prometheus.GaugeValue, float64(ahead), repo.ProjectKey, repo.Slug, b.Name),
+			prometheus.MustNewConstMetric(c.branchBehind, prometheus.GaugeValue, float64(behind), repo.ProjectKey, repo.Slug, b.Name))
+	}
+	return metrics
+}
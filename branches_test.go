@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// staticCollector exposes a fixed set of metrics so helpers returning []prometheus.Metric can be scraped.
+type staticCollector []prometheus.Metric
+
+func (s staticCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (s staticCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range s {
+		ch <- m
+	}
+}
+
+func TestBranchMetrics_StaleDataCenter(t *testing.T) {
+	daysAgo := func(n int) map[string]interface{} {
+		return map[string]interface{}{dcLatestCommitMetadata: map[string]int64{"committerTimestamp": time.Now().AddDate(0, 0, -n).UnixMilli()}}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/api/1.0/projects/PRJ/repos/app/branches" {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(page(
+			map[string]interface{}{"displayId": "master", "latestCommit": "a1", "metadata": daysAgo(2)},
+			map[string]interface{}{"displayId": "feature/x", "latestCommit": "b2", "metadata": daysAgo(100)},
+			map[string]interface{}{"displayId": "hotfix/y", "latestCommit": "c3", "metadata": daysAgo(40)},
+			// Without commit metadata the age is unknown: counted, never stale.
+			map[string]interface{}{"displayId": "no-metadata", "latestCommit": "d4"},
+		))
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+	cfg := &Config{StaleBranchDays: []int{30, 90}, StaleBranchTopN: 2}
+	c := NewBitbucketCollector(client, cfg, "info", 0)
+
+	out := scrape(t, staticCollector(c.branchMetrics(Repository{ProjectKey: "PRJ", Slug: "app"}, "master")))
+	for _, want := range []string{
+		`bitbucket_repo_branches_total{project_key="PRJ",repo_slug="app"} 4`,
+		`bitbucket_repo_stale_branches{project_key="PRJ",repo_slug="app",threshold="30d"} 2`,
+		`bitbucket_repo_stale_branches{project_key="PRJ",repo_slug="app",threshold="90d"} 1`,
+		`bitbucket_repo_oldest_branch_age_seconds{branch="feature/x",project_key="PRJ",repo_slug="app"}`,
+		`bitbucket_repo_oldest_branch_age_seconds{branch="hotfix/y",project_key="PRJ",repo_slug="app"}`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{`branch="master"`, `branch="no-metadata"`} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("oldest branches beyond the top 2 reported: %s", unwanted)
+		}
+	}
+}
+
+func TestBranchMetrics_StaleAndDrift(t *testing.T) {
+	day := func(n int) string { return time.Now().AddDate(0, 0, -n).Format(time.RFC3339) }
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		switch r.URL.Path {
+		case "/2.0/repositories/testws/app/refs/branches":
+			enc.Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"name": "main", "target": map[string]interface{}{"date": day(1)}},
+				map[string]interface{}{"name": "release/1.0", "target": map[string]interface{}{"date": day(45)}},
+				map[string]interface{}{"name": "feature/old", "target": map[string]interface{}{"date": day(200)}},
+			}})
+		case "/2.0/repositories/testws/app/commits/release/1.0":
+			enc.Encode(map[string]interface{}{"values": []interface{}{map[string]interface{}{}}})
+		case "/2.0/repositories/testws/app/commits/main":
+			enc.Encode(map[string]interface{}{"values": []interface{}{map[string]interface{}{}, map[string]interface{}{}, map[string]interface{}{}}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	cfg := &Config{StaleBranchDays: []int{30, 90, 180}, StaleBranchTopN: 1, TrackedBranches: []string{"release/*"}}
+	c := NewBitbucketCollector(client, cfg, "info", 0)
+
+	out := scrape(t, staticCollector(c.branchMetrics(Repository{ProjectKey: "PRJ", Slug: "app"}, "main")))
+	for _, want := range []string{
+		`bitbucket_repo_branches_total{project_key="PRJ",repo_slug="app"} 3`,
+		`bitbucket_repo_stale_branches{project_key="PRJ",repo_slug="app",threshold="30d"} 2`,
+		`bitbucket_repo_stale_branches{project_key="PRJ",repo_slug="app",threshold="90d"} 1`,
+		`bitbucket_repo_stale_branches{project_key="PRJ",repo_slug="app",threshold="180d"} 1`,
+		`bitbucket_repo_oldest_branch_age_seconds{branch="feature/old",project_key="PRJ",repo_slug="app"}`,
+		`bitbucket_branch_commits_ahead{branch="release/1.0",project_key="PRJ",repo_slug="app"} 1`,
+		`bitbucket_branch_commits_behind{branch="release/1.0",project_key="PRJ",repo_slug="app"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q", want)
+		}
+	}
+	if strings.Contains(out, `bitbucket_branch_commits_ahead{branch="feature/old"`) {
+		t.Errorf("untracked branch must not be compared")
+	}
+}
+
+func TestBranchMetrics_DriftDataCenter(t *testing.T) {
+	var starts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects/PRJ/repos/app/branches":
+			enc.Encode(page(
+				map[string]interface{}{"displayId": "master", "latestCommit": "a1"},
+				map[string]interface{}{"displayId": "release/1.0", "latestCommit": "b2"},
+			))
+		case "/rest/api/1.0/projects/PRJ/repos/app/compare/commits":
+			q := r.URL.Query()
+			switch [3]string{q.Get("from"), q.Get("to"), q.Get("start")} {
+			// Ahead: two pages.
+			case [3]string{"release/1.0", "master", "0"}:
+				starts = append(starts, "0")
+				enc.Encode(map[string]interface{}{"size": 2, "isLastPage": false, "nextPageStart": 2})
+			case [3]string{"release/1.0", "master", "2"}:
+				starts = append(starts, "2")
+				enc.Encode(map[string]interface{}{"size": 1, "isLastPage": true})
+			// Behind: a single page.
+			case [3]string{"master", "release/1.0", "0"}:
+				enc.Encode(map[string]interface{}{"size": 5, "isLastPage": true})
+			default:
+				w.WriteHeader(400)
+			}
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+	cfg := &Config{TrackedBranches: []string{"release/*"}}
+	c := NewBitbucketCollector(client, cfg, "info", 0)
+
+	out := scrape(t, staticCollector(c.branchMetrics(Repository{ProjectKey: "PRJ", Slug: "app"}, "master")))
+	for _, want := range []string{
+		`bitbucket_branch_commits_ahead{branch="release/1.0",project_key="PRJ",repo_slug="app"} 3`,
+		`bitbucket_branch_commits_behind{branch="release/1.0",project_key="PRJ",repo_slug="app"} 5`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if len(starts) != 2 || starts[1] != "2" {
+		t.Errorf("ahead pages requested at starts %v, want [0 2]", starts)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// buildStatusHistoryDepth is how many default-branch commits are searched for the last successful build.
+const buildStatusHistoryDepth = 20
+
+// buildStatus is a commit build status normalised across Cloud and Data Center.
+type buildStatus struct {
+	Key     string
+	State   string
+	Updated time.Time
+}
+
+// CommitStatuses returns the build statuses reported against a commit.
+func (c *BitbucketClient) CommitStatuses(repo Repository, hash string) ([]buildStatus, error) {
+	var statuses []buildStatus
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			Key       string `json:"key"`
+			State     string `json:"state"`
+			UpdatedOn string `json:"updated_on"`
+		}](c, c.repoPath(repo)+"/commit/"+hash+"/statuses?pagelen=100")
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			updated, _ := time.Parse(time.RFC3339, v.UpdatedOn)
+			statuses = append(statuses, buildStatus{v.Key, v.State, updated})
+		}
+		return statuses, nil
+	}
+	values, err := serverPages[struct {
+		Key       string `json:"key"`
+		State     string `json:"state"`
+		DateAdded int64  `json:"dateAdded"`
+	}](c, c.BaseURL+"/rest/build-status/1.0/commits/"+hash+"?limit=100")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		statuses = append(statuses, buildStatus{v.Key, v.State, time.UnixMilli(v.DateAdded)})
+	}
+	return statuses, nil
+}
+
+// branchCommits returns the hashes of the newest commits on a branch, newest first.
+func (c *BitbucketClient) branchCommits(repo Repository, branch string, limit int) ([]string, error) {
+	var hashes []string
+	if c.Cloud {
+		var data struct {
+			Values []struct {
+				Hash string `json:"hash"`
+			} `json:"values"`
+		}
+		if err := c.getJSON(fmt.Sprintf("%s/commits/%s?pagelen=%d", c.repoPath(repo), url.PathEscape(branch), limit), &data); err != nil {
+			return nil, err
+		}
+		for _, v := range data.Values {
+			hashes = append(hashes, v.Hash)
+		}
+		return hashes, nil
+	}
+	var data struct {
+		Values []struct {
+			ID string `json:"id"`
+		} `json:"values"`
+	}
+	if err := c.getJSON(fmt.Sprintf("%s/commits?until=%s&limit=%d", c.repoPath(repo), url.QueryEscape(branch), limit), &data); err != nil {
+		return nil, err
+	}
+	for _, v := range data.Values {
+		hashes = append(hashes, v.ID)
+	}
+	return hashes, nil
+}
+
+// buildStatusMetrics reports the build statuses that CI systems post back to
+// Bitbucket for the head of the default branch and of each open pull request
+// in prs, and the age of the last successful build on the default branch.
+// branch and head are empty when the default branch could not be resolved.
+func (c *BitbucketCollector) buildStatusMetrics(repo Repository, branch, head string, prs []PullRequest) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	// Several open PRs can share a source branch; report each head once. A
+	// fork's branch can share its name with one in the repo, so heads are
+	// keyed by [source, branch].
+	heads := make(map[[2]string]string)
+	if branch != "" {
+		if head != "" {
+			heads[[2]string{"default_branch", branch}] = head
+		}
+		metrics = append(metrics, c.lastSuccessMetrics(repo, branch)...)
+	}
+	for _, pr := range prs {
+		heads[[2]string{pr.SourceRepo, pr.SourceBranch}] = pr.SourceCommit
+	}
+	for key, hash := range heads {
+		statuses, err := c.client.CommitStatuses(repo, hash)
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch build statuses for %s@%s: %v", repo.Slug, hash, err)
+			continue
+		}
+		for _, s := range statuses {
+			metrics = append(metrics, prometheus.MustNewConstMetric(c.commitBuildStatus, prometheus.GaugeValue, 1, repo.ProjectKey, repo.Slug, key[1], key[0], s.Key, s.State))
+		}
+	}
+	return metrics
+}
+
+// lastSuccessMetrics walks back from the default branch head to the most
+// recent commit with a SUCCESSFUL build and reports how long ago it was built.
+func (c *BitbucketCollector) lastSuccessMetrics(repo Repository, branch string) []prometheus.Metric {
+	hashes, err := c.client.branchCommits(repo, branch, buildStatusHistoryDepth)
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch commits of %s@%s: %v", repo.Slug, branch, err)
+		return nil
+	}
+	for _, hash := range hashes {
+		statuses, err := c.client.CommitStatuses(repo, hash)
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch build statuses for %s@%s: %v", repo.Slug, hash, err)
+			return nil
+		}
+		var latest time.Time
+		for _, s := range statuses {
+			if s.State == "SUCCESSFUL" && s.Updated.After(latest) {
+				latest = s.Updated
+			}
+		}
+		if !latest.IsZero() {
+			return []prometheus.Metric{prometheus.MustNewConstMetric(c.lastSuccessfulAge, prometheus.GaugeValue, time.Since(latest).Seconds(), repo.ProjectKey, repo.Slug, branch)}
+		}
+	}
+	return nil
+}
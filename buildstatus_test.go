@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildStatusMetrics_Cloud(t *testing.T) {
+	anHourAgo := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	status := func(key, state string) map[string]string {
+		return map[string]string{"key": key, "state": state, "updated_on": anHourAgo}
+	}
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/2.0/repositories/testws/app/commits/main":
+			body = map[string]interface{}{"values": []interface{}{map[string]string{"hash": "h1"}, map[string]string{"hash": "h0"}}}
+		case "/2.0/repositories/testws/app/commit/h1/statuses":
+			body = map[string]interface{}{"values": []interface{}{status("ci", "INPROGRESS")}}
+		case "/2.0/repositories/testws/app/commit/h0/statuses":
+			body = map[string]interface{}{"values": []interface{}{status("ci", "SUCCESSFUL")}}
+		case "/2.0/repositories/testws/app/commit/f1/statuses":
+			body = map[string]interface{}{"values": []interface{}{status("ci", "FAILED")}}
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+
+	c := NewBitbucketCollector(client, &Config{}, "info", 0)
+	// A fork's branch named like the default branch.
+	prs := []PullRequest{{ID: 7, SourceBranch: "main", SourceCommit: "f1", SourceRepo: "alice/app"}}
+	out := scrape(t, staticCollector(c.buildStatusMetrics(Repository{ProjectKey: "PRJ", Slug: "app"}, "main", "h1", prs)))
+	for _, want := range []string{
+		`bitbucket_commit_build_status{branch="main",key="ci",project_key="PRJ",repo_slug="app",source="default_branch",state="INPROGRESS"} 1`,
+		`bitbucket_commit_build_status{branch="main",key="ci",project_key="PRJ",repo_slug="app",source="alice/app",state="FAILED"} 1`,
+		`bitbucket_default_branch_last_successful_build_age_seconds{branch="main",project_key="PRJ",repo_slug="app"} 360`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestBuildStatusMetrics_DataCenter(t *testing.T) {
+	added := time.Now().Add(-2 * time.Hour).UnixMilli()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects/PRJ/repos/app/commits":
+			body = page(map[string]string{"id": "h1"}, map[string]string{"id": "h0"})
+		case "/rest/build-status/1.0/commits/h1":
+			body = page(map[string]interface{}{"key": "jenkins", "state": "FAILED", "dateAdded": added})
+		case "/rest/build-status/1.0/commits/h0":
+			body = page(map[string]interface{}{"key": "jenkins", "state": "SUCCESSFUL", "dateAdded": added})
+		case "/rest/build-status/1.0/commits/p1":
+			body = page(map[string]interface{}{"key": "jenkins", "state": "SUCCESSFUL", "dateAdded": added})
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+
+	c := NewBitbucketCollector(client, &Config{}, "info", 0)
+	prs := []PullRequest{{ID: 3, SourceBranch: "feature/x", SourceCommit: "p1", SourceRepo: "PRJ/app"}}
+	out := scrape(t, staticCollector(c.buildStatusMetrics(Repository{ProjectKey: "PRJ", Slug: "app"}, "master", "h1", prs)))
+	for _, want := range []string{
+		`bitbucket_commit_build_status{branch="master",key="jenkins",project_key="PRJ",repo_slug="app",source="default_branch",state="FAILED"} 1`,
+		`bitbucket_commit_build_status{branch="feature/x",key="jenkins",project_key="PRJ",repo_slug="app",source="PRJ/app",state="SUCCESSFUL"} 1`,
+		`bitbucket_default_branch_last_successful_build_age_seconds{branch="master",project_key="PRJ",repo_slug="app"} 720`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestBuildStatusMetrics_DataCenterSharedSlug(t *testing.T) {
+	added := time.Now().Add(-time.Hour).UnixMilli()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{} = page()
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects/ONE/repos/api/commits":
+			body = page(map[string]string{"id": "a1"})
+		case "/rest/api/1.0/projects/TWO/repos/api/commits":
+			body = page(map[string]string{"id": "b1"})
+		case "/rest/build-status/1.0/commits/a1":
+			body = page(map[string]interface{}{"key": "jenkins", "state": "SUCCESSFUL", "dateAdded": added})
+		case "/rest/build-status/1.0/commits/b1":
+			body = page(map[string]interface{}{"key": "jenkins", "state": "FAILED", "dateAdded": added})
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+
+	c := NewBitbucketCollector(client, &Config{}, "info", 0)
+	// Both repos are called api; without the project key their series would
+	// collide and fail the whole scrape.
+	metrics := c.buildStatusMetrics(Repository{ProjectKey: "ONE", Slug: "api"}, "master", "a1", nil)
+	metrics = append(metrics, c.buildStatusMetrics(Repository{ProjectKey: "TWO", Slug: "api"}, "master", "b1", nil)...)
+	out := scrape(t, staticCollector(metrics))
+	for _, want := range []string{
+		`bitbucket_commit_build_status{branch="master",key="jenkins",project_key="ONE",repo_slug="api",source="default_branch",state="SUCCESSFUL"} 1`,
+		`bitbucket_commit_build_status{branch="master",key="jenkins",project_key="TWO",repo_slug="api",source="default_branch",state="FAILED"} 1`,
+		`bitbucket_default_branch_last_successful_build_age_seconds{branch="master",project_key="ONE",repo_slug="api"} 360`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `last_successful_build_age_seconds{branch="master",project_key="TWO"`) {
+		t.Errorf("repo without a successful build reported one\n%s", out)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,26 +26,40 @@ type BitbucketCollector struct {
 	perRepoLastCommit *prometheus.Desc
 	// PR metrics
 	perRepoOpenPRs   *prometheus.Desc
-	prMergedTotal    *prometheus.Desc
 	prAgeSeconds     *prometheus.Desc
 	prReviewersTotal *prometheus.Desc
 	// Commit/Author metrics
 	perUserCommits   *prometheus.Desc
 	commitAgeSeconds *prometheus.Desc
-	// User/Access metrics
-	perUserAccessRepos *prometheus.Desc
-	teamMembersTotal   *prometheus.Desc
-	// Pipeline/Build metrics
-	pipelineRunsTotal       *prometheus.Desc
-	pipelineDurationSeconds *prometheus.Desc
-	pipelineActiveTotal     *prometheus.Desc
 	// Branch/Policy metrics
 	branchRestrictionsTotal     *prometheus.Desc
 	branchDefaultPolicyEnforced *prometheus.Desc
-	// Webhook metrics
-	webhooksTotal                  *prometheus.Desc
-	webhookFailuresTotal           *prometheus.Desc
-	webhookDeliveryDurationSeconds *prometheus.Desc
+	branchPolicyRuleCompliant   *prometheus.Desc
+	requiredBranchPolicy        map[string]int
+	// Repo settings compliance
+	repoInfo            *prometheus.Desc
+	repoIsPrivate       *prometheus.Desc
+	repoHasIssues       *prometheus.Desc
+	repoHasWiki         *prometheus.Desc
+	repoCreatedTime     *prometheus.Desc
+	repoUpdatedTime     *prometheus.Desc
+	repoPolicyViolation *prometheus.Desc
+	repoRules           map[string]string
+	// Review coverage metrics
+	defaultReviewersTotal *prometheus.Desc
+	codeownersPresent     *prometheus.Desc
+	prsWithReviewer       *prometheus.Desc
+	prReviewerCoverage    *prometheus.Desc
+	// Data Center instance health
+	serverStatus      *prometheus.Desc
+	clusterNodesTotal *prometheus.Desc
+	clusterNodeInfo   *prometheus.Desc
+	meshNodes         *prometheus.Desc
+	componentHealthy  *prometheus.Desc
+	// Repo size growth and LFS
+	repoSizeGrowth *prometheus.Desc
+	repoLFSEnabled *prometheus.Desc
+	sizeHistory    *sizeHistory
 	// API/Exporter health
 	apiRateLimitRemaining    *prometheus.Desc
 	apiRateLimitResetSeconds *prometheus.Desc
@@ -55,44 +70,108 @@ type BitbucketCollector struct {
 	issuesTotal   *prometheus.Desc
 	releasesTotal *prometheus.Desc
 	logLevel      string
+
+	// Branch metrics
+	branchesTotal   *prometheus.Desc
+	staleBranches   *prometheus.Desc
+	oldestBranchAge *prometheus.Desc
+	staleBranchDays []int
+	staleBranchTopN int
+	branchAhead     *prometheus.Desc
+	branchBehind    *prometheus.Desc
+	trackedBranches []string
+
+	// Build statuses posted by CI systems
+	commitBuildStatus *prometheus.Desc
+	lastSuccessfulAge *prometheus.Desc
+
+	// Access tokens and keys
+	credentialExpiry      *prometheus.Desc
+	credentialAge         *prometheus.Desc
+	credentialLastUsedAge *prometheus.Desc
+	credentialsNoExpiry   *prometheus.Desc
+
+	// Commit and PR authorship seen while refreshing, read by MemberCollector
+	activity    *activityTracker
+	dormantDays int
+
+	// Per-repo snapshot cache, see RefreshRepo
+	refreshInterval time.Duration
+	snapshotMu      sync.Mutex
+	snapshots       map[string]repoSnapshot
+	lastFullRefresh time.Time
+	fullRefreshing  bool // a full cycle is in flight, see claimFullRefresh
+	// Data Center project tokens and keys, refreshed with each full cycle
+	projectCredentials []credential
 }
 
-func NewBitbucketCollector(client *BitbucketClient, logLevel string) *BitbucketCollector {
+func NewBitbucketCollector(client *BitbucketClient, cfg *Config, logLevel string, refreshInterval time.Duration) *BitbucketCollector {
 	return &BitbucketCollector{
-		client:                         client,
-		repoCount:                      prometheus.NewDesc("bitbucket_repository_count", "Total number of repositories", nil, nil),
-		prCount:                        prometheus.NewDesc("bitbucket_open_pull_requests", "Total number of open pull requests", nil, nil),
-		userCount:                      prometheus.NewDesc("bitbucket_user_count", "Total number of users", nil, nil),
-		projectCount:                   prometheus.NewDesc("bitbucket_project_count", "Total number of projects", nil, nil),
-		perProjectRepos:                prometheus.NewDesc("bitbucket_project_repos", "Number of repositories per project", []string{"project_key", "project_name", "project_uuid", "project_type", "project_is_private", "project_created_on", "project_updated_on", "project_has_publicly_visible_repos"}, nil),
-		perRepoCommits:                 prometheus.NewDesc("bitbucket_repo_commits", "Number of commits per repo", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
-		perRepoPRs:                     prometheus.NewDesc("bitbucket_repo_open_prs", "Number of open PRs per repo", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
-		perRepoSize:                    prometheus.NewDesc("bitbucket_repo_size_bytes", "Size of each repository in bytes", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
-		perRepoLastCommit:              prometheus.NewDesc("bitbucket_repo_last_commit_timestamp", "Unix timestamp of last commit in repo", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
-		perRepoOpenPRs:                 prometheus.NewDesc("bitbucket_repo_open_prs", "Number of open PRs per repository", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
-		prMergedTotal:                  prometheus.NewDesc("bitbucket_pull_requests_merged_total", "Cumulative number of merged pull requests", nil, nil),
-		prAgeSeconds:                   prometheus.NewDesc("bitbucket_pull_request_age_seconds", "Age of each PR in seconds", []string{"project_key", "repo_slug", "pr_id", "state"}, nil),
-		prReviewersTotal:               prometheus.NewDesc("bitbucket_pull_request_reviewers_total", "Number of reviewers per PR", []string{"project_key", "repo_slug", "pr_id"}, nil),
-		perUserCommits:                 prometheus.NewDesc("bitbucket_user_commits", "Number of commits per user per repo", []string{"project_key", "project_name", "repo_slug", "repo_name", "user"}, nil),
-		commitAgeSeconds:               prometheus.NewDesc("bitbucket_commit_age_seconds", "Age of commits in seconds (latest only)", []string{"repo_slug"}, nil),
-		perUserAccessRepos:             prometheus.NewDesc("bitbucket_user_access_repos_total", "Number of repositories accessed per user", []string{"user", "permission_level"}, nil),
-		teamMembersTotal:               prometheus.NewDesc("bitbucket_team_members_total", "Number of members per team (Bitbucket Cloud)", []string{"team_name"}, nil),
-		pipelineRunsTotal:              prometheus.NewDesc("bitbucket_pipeline_runs_total", "Number of pipeline runs by result", []string{"repo_slug", "result"}, nil),
-		pipelineDurationSeconds:        prometheus.NewDesc("bitbucket_pipeline_duration_seconds", "Duration of each pipeline run", []string{"repo_slug"}, nil),
-		pipelineActiveTotal:            prometheus.NewDesc("bitbucket_pipeline_active_total", "Currently running pipelines", []string{"repo_slug"}, nil),
-		branchRestrictionsTotal:        prometheus.NewDesc("bitbucket_branch_restrictions_total", "Number of branch restrictions per branch", []string{"project_key", "repo_slug", "branch_name", "restriction_type"}, nil),
-		branchDefaultPolicyEnforced:    prometheus.NewDesc("bitbucket_branch_default_policy_enforced", "Whether default branch has policy enforced (0/1)", []string{"repo_slug", "branch_name"}, nil),
-		webhooksTotal:                  prometheus.NewDesc("bitbucket_webhooks_total", "Total number of webhooks configured", []string{"repo_slug", "status"}, nil),
-		webhookFailuresTotal:           prometheus.NewDesc("bitbucket_webhook_failures_total", "Number of webhook failures", []string{"repo_slug", "event_type", "endpoint"}, nil),
-		webhookDeliveryDurationSeconds: prometheus.NewDesc("bitbucket_webhook_delivery_duration_seconds", "Duration of webhook delivery", []string{"repo_slug", "event_type"}, nil),
-		apiRateLimitRemaining:          prometheus.NewDesc("bitbucket_api_rate_limit_remaining", "Remaining API rate limit (Cloud)", nil, nil),
-		apiRateLimitResetSeconds:       prometheus.NewDesc("bitbucket_api_rate_limit_reset_seconds", "Time in seconds until rate limit reset", nil, nil),
-		exporterUp:                     prometheus.NewDesc("bitbucket_exporter_up", "Whether the Bitbucket exporter is running successfully", nil, nil),
-		exporterErrorsTotal:            prometheus.NewDesc("bitbucket_exporter_errors_total", "Total number of errors in exporter", []string{"error_type", "component"}, nil),
-		tagsTotal:                      prometheus.NewDesc("bitbucket_tags_total", "Number of Git tags in repository", []string{"repo_slug"}, nil),
-		issuesTotal:                    prometheus.NewDesc("bitbucket_issues_total", "Number of open issues (Cloud only, if enabled)", []string{"repo_slug", "status"}, nil),
-		releasesTotal:                  prometheus.NewDesc("bitbucket_releases_total", "Number of releases per repository (if supported)", []string{"repo_slug"}, nil),
-		logLevel:                       logLevel,
+		client:                      client,
+		repoCount:                   prometheus.NewDesc("bitbucket_repository_count", "Total number of repositories", nil, nil),
+		prCount:                     prometheus.NewDesc("bitbucket_open_pull_requests", "Total number of open pull requests", nil, nil),
+		userCount:                   prometheus.NewDesc("bitbucket_user_count", "Total number of users", nil, nil),
+		projectCount:                prometheus.NewDesc("bitbucket_project_count", "Total number of projects", nil, nil),
+		perProjectRepos:             prometheus.NewDesc("bitbucket_project_repos", "Number of repositories per project", []string{"project_key", "project_name", "project_uuid", "project_type", "project_is_private", "project_created_on", "project_updated_on", "project_has_publicly_visible_repos"}, nil),
+		perRepoCommits:              prometheus.NewDesc("bitbucket_repo_commits", "Number of commits per repo", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
+		perRepoPRs:                  prometheus.NewDesc("bitbucket_repo_open_prs", "Number of open PRs per repo", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
+		perRepoSize:                 prometheus.NewDesc("bitbucket_repo_size_bytes", "Size of each repository in bytes", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
+		perRepoLastCommit:           prometheus.NewDesc("bitbucket_repo_last_commit_timestamp", "Unix timestamp of last commit in repo", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
+		perRepoOpenPRs:              prometheus.NewDesc("bitbucket_repo_open_prs", "Number of open PRs per repository", []string{"project_key", "project_name", "repo_slug", "repo_name"}, nil),
+		prAgeSeconds:                prometheus.NewDesc("bitbucket_pull_request_age_seconds", "Age of each PR in seconds", []string{"project_key", "repo_slug", "pr_id", "state"}, nil),
+		prReviewersTotal:            prometheus.NewDesc("bitbucket_pull_request_reviewers_total", "Number of reviewers per PR", []string{"project_key", "repo_slug", "pr_id"}, nil),
+		perUserCommits:              prometheus.NewDesc("bitbucket_user_commits", "Number of commits per user per repo", []string{"project_key", "project_name", "repo_slug", "repo_name", "user"}, nil),
+		commitAgeSeconds:            prometheus.NewDesc("bitbucket_commit_age_seconds", "Age of commits in seconds (latest only)", []string{"repo_slug"}, nil),
+		branchRestrictionsTotal:     prometheus.NewDesc("bitbucket_branch_restrictions_total", "Number of branch restrictions per branch", []string{"project_key", "repo_slug", "restriction_type", "matcher_type", "matcher_value", "inherited"}, nil),
+		branchDefaultPolicyEnforced: prometheus.NewDesc("bitbucket_branch_default_policy_enforced", "Whether default branch has policy enforced (0/1)", []string{"project_key", "repo_slug", "branch_name"}, nil),
+		branchPolicyRuleCompliant:   prometheus.NewDesc("bitbucket_branch_default_policy_rule_compliant", "Whether default branch complies with a rule of the required branch policy (0/1)", []string{"project_key", "repo_slug", "branch_name", "rule"}, nil),
+		requiredBranchPolicy:        cfg.RequiredBranchPolicy,
+		repoInfo:                    prometheus.NewDesc("bitbucket_repo_info", "Security-relevant settings of repo", append([]string{"project_key", "repo_slug"}, repoSettingNames...), nil),
+		repoIsPrivate:               prometheus.NewDesc("bitbucket_repo_is_private", "Whether repo is private (0/1)", []string{"project_key", "repo_slug"}, nil),
+		repoHasIssues:               prometheus.NewDesc("bitbucket_repo_has_issues", "Whether the issue tracker is enabled (0/1, Cloud only)", []string{"project_key", "repo_slug"}, nil),
+		repoHasWiki:                 prometheus.NewDesc("bitbucket_repo_has_wiki", "Whether the wiki is enabled (0/1, Cloud only)", []string{"project_key", "repo_slug"}, nil),
+		repoCreatedTime:             prometheus.NewDesc("bitbucket_repo_created_timestamp", "Unix timestamp of repo creation (Cloud only)", []string{"project_key", "repo_slug"}, nil),
+		repoUpdatedTime:             prometheus.NewDesc("bitbucket_repo_updated_timestamp", "Unix timestamp of the last repo update (Cloud only)", []string{"project_key", "repo_slug"}, nil),
+		repoPolicyViolation:         prometheus.NewDesc("bitbucket_repo_policy_violation", "Whether a repo setting differs from the configured rule (0/1)", []string{"project_key", "repo_slug", "rule"}, nil),
+		repoRules:                   cfg.RepoRules,
+		defaultReviewersTotal:       prometheus.NewDesc("bitbucket_repo_default_reviewers_total", "Number of default reviewers configured for repo", []string{"project_key", "repo_slug"}, nil),
+		codeownersPresent:           prometheus.NewDesc("bitbucket_repo_codeowners_present", "Whether the default branch has a CODEOWNERS file (0/1)", []string{"project_key", "repo_slug"}, nil),
+		prsWithReviewer:             prometheus.NewDesc("bitbucket_repo_open_prs_with_reviewer", "Number of open PRs with at least one reviewer", []string{"project_key", "repo_slug"}, nil),
+		prReviewerCoverage:          prometheus.NewDesc("bitbucket_repo_open_prs_reviewer_coverage_ratio", "Fraction of open PRs with at least one reviewer", []string{"project_key", "repo_slug"}, nil),
+		serverStatus:                prometheus.NewDesc("bitbucket_server_status", "Application state from /status (1 for the current state, Data Center)", []string{"state"}, nil),
+		clusterNodesTotal:           prometheus.NewDesc("bitbucket_cluster_nodes_total", "Number of nodes in the Data Center cluster", nil, nil),
+		clusterNodeInfo:             prometheus.NewDesc("bitbucket_cluster_node_info", "Data Center cluster node", []string{"node_id", "name", "address", "local"}, nil),
+		meshNodes:                   prometheus.NewDesc("bitbucket_mesh_nodes", "Number of Mesh nodes by state (Data Center)", []string{"state"}, nil),
+		componentHealthy:            prometheus.NewDesc("bitbucket_component_healthy", "Whether a Data Center subsystem is healthy (0/1)", []string{"component"}, nil),
+		repoSizeGrowth:              prometheus.NewDesc("bitbucket_repo_size_growth_bytes_per_day", "Average repo size growth in bytes per day over the window", []string{"project_key", "repo_slug", "window"}, nil),
+		repoLFSEnabled:              prometheus.NewDesc("bitbucket_repo_lfs_enabled", "Whether Git LFS is enabled on repo (0/1, Data Center only)", []string{"project_key", "repo_slug"}, nil),
+		sizeHistory:                 newSizeHistory(cfg.SizeHistoryFile, cfg.SizeGrowthWindows),
+		apiRateLimitRemaining:       prometheus.NewDesc("bitbucket_api_rate_limit_remaining", "Remaining API rate limit (Cloud)", nil, nil),
+		apiRateLimitResetSeconds:    prometheus.NewDesc("bitbucket_api_rate_limit_reset_seconds", "Time in seconds until rate limit reset", nil, nil),
+		exporterUp:                  prometheus.NewDesc("bitbucket_exporter_up", "Whether the Bitbucket exporter is running successfully", nil, nil),
+		exporterErrorsTotal:         prometheus.NewDesc("bitbucket_exporter_errors_total", "Total number of errors in exporter", []string{"error_type", "component"}, nil),
+		tagsTotal:                   prometheus.NewDesc("bitbucket_tags_total", "Number of Git tags in repository", []string{"repo_slug"}, nil),
+		issuesTotal:                 prometheus.NewDesc("bitbucket_issues_total", "Number of open issues (Cloud only, if enabled)", []string{"repo_slug", "status"}, nil),
+		releasesTotal:               prometheus.NewDesc("bitbucket_releases_total", "Number of releases per repository (if supported)", []string{"repo_slug"}, nil),
+		logLevel:                    logLevel,
+		branchesTotal:               prometheus.NewDesc("bitbucket_repo_branches_total", "Total number of branches in repo", []string{"project_key", "repo_slug"}, nil),
+		staleBranches:               prometheus.NewDesc("bitbucket_repo_stale_branches", "Number of branches whose head commit is older than the threshold", []string{"project_key", "repo_slug", "threshold"}, nil),
+		oldestBranchAge:             prometheus.NewDesc("bitbucket_repo_oldest_branch_age_seconds", "Age of the head commit of the oldest branches in repo", []string{"project_key", "repo_slug", "branch"}, nil),
+		staleBranchDays:             cfg.StaleBranchDays,
+		staleBranchTopN:             cfg.StaleBranchTopN,
+		branchAhead:                 prometheus.NewDesc("bitbucket_branch_commits_ahead", "Commits on the branch that are not on the default branch", []string{"project_key", "repo_slug", "branch"}, nil),
+		branchBehind:                prometheus.NewDesc("bitbucket_branch_commits_behind", "Commits on the default branch that are not on the branch", []string{"project_key", "repo_slug", "branch"}, nil),
+		trackedBranches:             cfg.TrackedBranches,
+		commitBuildStatus:           prometheus.NewDesc("bitbucket_commit_build_status", "Build status reported for the head commit of a branch (1 for the reported state)", []string{"project_key", "repo_slug", "branch", "source", "key", "state"}, nil),
+		lastSuccessfulAge:           prometheus.NewDesc("bitbucket_default_branch_last_successful_build_age_seconds", "Seconds since the last successful build on the default branch", []string{"project_key", "repo_slug", "branch"}, nil),
+		credentialExpiry:            prometheus.NewDesc("bitbucket_credential_expiry_timestamp", "Unix timestamp the token or key expires", credentialLabels, nil),
+		credentialAge:               prometheus.NewDesc("bitbucket_credential_age_seconds", "Seconds since the token or key was created", credentialLabels, nil),
+		credentialLastUsedAge:       prometheus.NewDesc("bitbucket_credential_last_used_age_seconds", "Seconds since the token or key was last used", credentialLabels, nil),
+		credentialsNoExpiry:         prometheus.NewDesc("bitbucket_credentials_without_expiry_total", "Number of tokens and keys that never expire", []string{"kind"}, nil),
+		activity:                    newActivityTracker(),
+		dormantDays:                 cfg.DormantDays,
+		refreshInterval:             refreshInterval,
+		snapshots:                   make(map[string]repoSnapshot),
 	}
 }
 
@@ -216,56 +295,14 @@ func (c *BitbucketCollector) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(c.projectCount, prometheus.GaugeValue, float64(projectCount))
 
 		log.Println("Fetching all repositories from Bitbucket Cloud API...")
-		repoURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "?pagelen=100"
-		projectRepoCount := make(map[string]int)
-		var allRepos []struct {
-			ProjectKey  string
-			ProjectName string
-			RepoSlug    string
-			RepoName    string
+		allRepos, err := c.client.ListRepositories()
+		if err != nil {
+			log.Printf("Failed to fetch repos: %v", err)
 		}
-		for {
-			req, _ := http.NewRequest("GET", repoURL, nil)
-			req.SetBasicAuth(c.client.Username, c.client.Password)
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil || resp.StatusCode != 200 {
-				log.Printf("Failed to fetch repos: %v, status: %v", err, resp.StatusCode)
-				break
-			}
-			body, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			var repoData struct {
-				Values []struct {
-					Slug    string `json:"slug"`
-					Name    string `json:"name"`
-					Project struct {
-						Key  string `json:"key"`
-						Name string `json:"name"`
-					} `json:"project"`
-				} `json:"values"`
-				Next string `json:"next"`
-			}
-			if err := json.Unmarshal(body, &repoData); err != nil {
-				log.Printf("Failed to unmarshal repo data: %v", err)
-				break
-			}
-			for _, repo := range repoData.Values {
-				if repo.Project.Key == "" {
-					continue
-				}
-				projectRepoCount[repo.Project.Key]++
-				allRepos = append(allRepos, struct {
-					ProjectKey  string
-					ProjectName string
-					RepoSlug    string
-					RepoName    string
-				}{repo.Project.Key, repo.Project.Name, repo.Slug, repo.Name})
-				logf("Found repo: project_key=%s, project_name=%s, repo_slug=%s, repo_name=%s", repo.Project.Key, repo.Project.Name, repo.Slug, repo.Name)
-			}
-			if repoData.Next == "" {
-				break
-			}
-			repoURL = repoData.Next
+		projectRepoCount := make(map[string]int)
+		for _, repo := range allRepos {
+			projectRepoCount[repo.ProjectKey]++
+			logf("Found repo: project_key=%s, project_name=%s, repo_slug=%s, repo_name=%s", repo.ProjectKey, repo.ProjectName, repo.Slug, repo.Name)
 		}
 		repoCount = len(allRepos)
 		log.Printf("Total repositories found: %d", repoCount)
@@ -275,225 +312,16 @@ func (c *BitbucketCollector) Collect(ch chan<- prometheus.Metric) {
 			ch <- prometheus.MustNewConstMetric(
 				c.perProjectRepos, prometheus.GaugeValue, float64(count), projectKey, p.Name, p.UUID, p.Type, p.IsPrivate, p.CreatedOn, p.UpdatedOn, p.HasPubliclyVisibleRepos)
 		}
-		// Per-repo PRs and commits, and per-user commits (aggregate first)
-		for _, repo := range allRepos {
-			// Open PRs per repo
-			prURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/pullrequests?state=OPEN&pagelen=1"
-			reqPR, _ := http.NewRequest("GET", prURL, nil)
-			reqPR.SetBasicAuth(c.client.Username, c.client.Password)
-			respPR, err := http.DefaultClient.Do(reqPR)
-			prCount := 0
-			if err == nil && respPR.StatusCode == 200 {
-				bodyPR, _ := io.ReadAll(respPR.Body)
-				var prData struct {
-					Size int `json:"size"`
-				}
-				if err := json.Unmarshal(bodyPR, &prData); err == nil {
-					prCount = prData.Size
-				}
-				respPR.Body.Close()
-			}
-			ch <- prometheus.MustNewConstMetric(
-				c.perRepoPRs, prometheus.GaugeValue, float64(prCount), repo.ProjectKey, repo.ProjectName, repo.RepoSlug, repo.RepoName)
-
-			// Commits per repo and user (aggregate before emitting)
-			commitsURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/commits?pagelen=100"
-			totalCommits := 0
-			committerMap := make(map[string]int)
-			for {
-				reqC, _ := http.NewRequest("GET", commitsURL, nil)
-				reqC.SetBasicAuth(c.client.Username, c.client.Password)
-				respC, err := http.DefaultClient.Do(reqC)
-				if err != nil || respC.StatusCode != 200 {
-					break
-				}
-				bodyC, _ := io.ReadAll(respC.Body)
-				respC.Body.Close()
-				var commitData struct {
-					Values []struct {
-						Author struct {
-							Raw string `json:"raw"`
-						} `json:"author"`
-					} `json:"values"`
-					Next string `json:"next"`
-				}
-				if err := json.Unmarshal(bodyC, &commitData); err != nil {
-					break
-				}
-				totalCommits += len(commitData.Values)
-				for _, commit := range commitData.Values {
-					committerMap[commit.Author.Raw]++
-				}
-				if commitData.Next == "" {
-					break
-				}
-				commitsURL = commitData.Next
-			}
-			ch <- prometheus.MustNewConstMetric(
-				c.perRepoCommits, prometheus.GaugeValue, float64(totalCommits), repo.ProjectKey, repo.ProjectName, repo.RepoSlug, repo.RepoName)
-			for user, count := range committerMap {
-				ch <- prometheus.MustNewConstMetric(
-					c.perUserCommits, prometheus.GaugeValue, float64(count), repo.ProjectKey, repo.ProjectName, repo.RepoSlug, repo.RepoName, user)
-			}
+		// Per-repo metrics come from the snapshot cache; a full cycle refreshes every repo
+		// once the cache is older than the refresh interval, webhooks refresh single repos in between.
+		if err == nil && c.claimFullRefresh() {
+			c.refreshAll(allRepos)
 		}
-
-		// Per-repo size and last commit, issues, releases, branch count, webhooks, branch restrictions
-		for _, repo := range allRepos {
-			// Per-repo size and last commit
-			repoInfoURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug
-			reqInfo, _ := http.NewRequest("GET", repoInfoURL, nil)
-			reqInfo.SetBasicAuth(c.client.Username, c.client.Password)
-			respInfo, err := http.DefaultClient.Do(reqInfo)
-			if respInfo != nil {
-				defer respInfo.Body.Close()
-			}
-			if err != nil || respInfo == nil || respInfo.StatusCode != 200 {
-				log.Printf("Failed to fetch repo info for %s: %v, status: %v", repo.RepoSlug, err, statusCodeSafe(respInfo))
-				exporterUpValue = 0
-				continue
-			}
-			bodyInfo, _ := io.ReadAll(respInfo.Body)
-			var repoInfo struct {
-				Size int64 `json:"size"`
-			}
-			if err := json.Unmarshal(bodyInfo, &repoInfo); err != nil {
-				log.Printf("Failed to unmarshal repo info for %s: %v", repo.RepoSlug, err)
-				exporterUpValue = 0
-				continue
-			}
-			ch <- prometheus.MustNewConstMetric(
-				c.perRepoSize, prometheus.GaugeValue, float64(repoInfo.Size), repo.ProjectKey, repo.ProjectName, repo.RepoSlug, repo.RepoName)
-
-			// Last commit timestamp
-			commitsURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/commits?pagelen=1"
-			reqLast, _ := http.NewRequest("GET", commitsURL, nil)
-			reqLast.SetBasicAuth(c.client.Username, c.client.Password)
-			respLast, err := http.DefaultClient.Do(reqLast)
-			if respLast != nil {
-				defer respLast.Body.Close()
-			}
-			if err != nil || respLast == nil || respLast.StatusCode != 200 {
-				log.Printf("Failed to fetch last commit for %s: %v, status: %v", repo.RepoSlug, err, statusCodeSafe(respLast))
-				exporterUpValue = 0
-				continue
-			}
-			bodyLast, _ := io.ReadAll(respLast.Body)
-			var commitData struct {
-				Values []struct {
-					Date string `json:"date"`
-				} `json:"values"`
-			}
-			if err := json.Unmarshal(bodyLast, &commitData); err != nil {
-				log.Printf("Failed to unmarshal last commit for %s: %v", repo.RepoSlug, err)
-				exporterUpValue = 0
-				continue
-			}
-			if len(commitData.Values) > 0 {
-				ts, err := parseRFC3339ToUnix(commitData.Values[0].Date)
-				if err == nil {
-					ch <- prometheus.MustNewConstMetric(
-						c.perRepoLastCommit, prometheus.GaugeValue, float64(ts), repo.ProjectKey, repo.ProjectName, repo.RepoSlug, repo.RepoName)
-				} else {
-					log.Printf("Failed to parse commit date for %s: %v", repo.RepoSlug, err)
-					exporterUpValue = 0
-				}
-			}
-
-			// Issues (open)
-			issuesURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/issues?state=open"
-			reqIssues, _ := http.NewRequest("GET", issuesURL, nil)
-			reqIssues.SetBasicAuth(c.client.Username, c.client.Password)
-			respIssues, err := http.DefaultClient.Do(reqIssues)
-			if err == nil && respIssues.StatusCode == 200 {
-				bodyIssues, _ := io.ReadAll(respIssues.Body)
-				respIssues.Body.Close()
-				var issuesData struct {
-					Size int `json:"size"`
-				}
-				if err := json.Unmarshal(bodyIssues, &issuesData); err == nil {
-					ch <- prometheus.MustNewConstMetric(
-						c.issuesTotal, prometheus.GaugeValue, float64(issuesData.Size), repo.RepoSlug, "open")
-				}
-			}
-
-			// Releases (tags)
-			tagsURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/refs/tags?pagelen=100"
-			reqTags, _ := http.NewRequest("GET", tagsURL, nil)
-			reqTags.SetBasicAuth(c.client.Username, c.client.Password)
-			respTags, err := http.DefaultClient.Do(reqTags)
-			if err == nil && respTags.StatusCode == 200 {
-				bodyTags, _ := io.ReadAll(respTags.Body)
-				respTags.Body.Close()
-				var tagsData struct {
-					Size int `json:"size"`
-				}
-				if err := json.Unmarshal(bodyTags, &tagsData); err == nil {
-					ch <- prometheus.MustNewConstMetric(
-						c.releasesTotal, prometheus.GaugeValue, float64(tagsData.Size), repo.RepoSlug)
-				}
-			}
-
-			// Branch count
-			branchesURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/refs/branches?pagelen=100"
-			reqBranches, _ := http.NewRequest("GET", branchesURL, nil)
-			reqBranches.SetBasicAuth(c.client.Username, c.client.Password)
-			respBranches, err := http.DefaultClient.Do(reqBranches)
-			if err == nil && respBranches.StatusCode == 200 {
-				bodyBranches, _ := io.ReadAll(respBranches.Body)
-				respBranches.Body.Close()
-				var branchesData struct {
-					Size int `json:"size"`
-				}
-				if err := json.Unmarshal(bodyBranches, &branchesData); err == nil {
-					ch <- prometheus.MustNewConstMetric(
-						prometheus.NewDesc("bitbucket_repo_branches_total", "Total number of branches in repo", []string{"repo_slug"}, nil), prometheus.GaugeValue, float64(branchesData.Size), repo.RepoSlug)
-				}
-			}
-
-			// Webhooks
-			webhooksURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/hooks?pagelen=100"
-			reqHooks, _ := http.NewRequest("GET", webhooksURL, nil)
-			reqHooks.SetBasicAuth(c.client.Username, c.client.Password)
-			respHooks, err := http.DefaultClient.Do(reqHooks)
-			if err == nil && respHooks.StatusCode == 200 {
-				bodyHooks, _ := io.ReadAll(respHooks.Body)
-				respHooks.Body.Close()
-				var hooksData struct {
-					Size int `json:"size"`
-				}
-				if err := json.Unmarshal(bodyHooks, &hooksData); err == nil {
-					ch <- prometheus.MustNewConstMetric(
-						c.webhooksTotal, prometheus.GaugeValue, float64(hooksData.Size), repo.RepoSlug, "active")
-				}
-			}
-
-			// Branch restrictions
-			restrictionsURL := "https://api.bitbucket.org/2.0/repositories/" + c.client.Workspace + "/" + repo.RepoSlug + "/branch-restrictions?pagelen=100"
-			reqRestrict, _ := http.NewRequest("GET", restrictionsURL, nil)
-			reqRestrict.SetBasicAuth(c.client.Username, c.client.Password)
-			respRestrict, err := http.DefaultClient.Do(reqRestrict)
-			if err == nil && respRestrict.StatusCode == 200 {
-				bodyRestrict, _ := io.ReadAll(respRestrict.Body)
-				respRestrict.Body.Close()
-				var restrictData struct {
-					Values []struct {
-						Branch string `json:"branch"`
-						Type   string `json:"type"`
-					} `json:"values"`
-				}
-				if err := json.Unmarshal(bodyRestrict, &restrictData); err == nil {
-					for _, r := range restrictData.Values {
-						ch <- prometheus.MustNewConstMetric(
-							c.branchRestrictionsTotal, prometheus.GaugeValue, 1, repo.ProjectKey, repo.RepoSlug, r.Branch, r.Type)
-					}
-				}
-			}
-
-			// Branch deleted (not available in API, log warning)
-			logf("Branch deleted metric not available in Bitbucket Cloud API; skipping.")
+		if !c.collectSnapshots(ch) {
+			exporterUpValue = 0
 		}
 	} else {
-		// Data Center logic (unchanged)
+		// Data Center: counts, cached per-repo metrics and server health
 		repoCount, err := c.client.GetRepositoryCount()
 		if err != nil {
 			log.Printf("error collecting repo count: %v", err)
@@ -508,7 +336,17 @@ func (c *BitbucketCollector) Collect(ch chan<- prometheus.Metric) {
 			logf("project count: %d", projectCount)
 			ch <- prometheus.MustNewConstMetric(c.projectCount, prometheus.GaugeValue, float64(projectCount))
 		}
-		// Add more Data Center/Server-safe metrics here as needed.
+		// Per-repo metrics, cached like on Cloud
+		allRepos, err := c.client.ListRepositories()
+		if err != nil {
+			log.Printf("error listing repositories: %v", err)
+		} else if c.claimFullRefresh() {
+			c.refreshAll(allRepos)
+		}
+		if !c.collectSnapshots(ch) {
+			exporterUpValue = 0
+		}
+		c.collectServerHealth(ch)
 	}
 	// Remove this line to avoid duplicate metric emission:
 	// ch <- prometheus.MustNewConstMetric(c.exporterUp, prometheus.GaugeValue, exporterUpValue)
@@ -548,6 +386,20 @@ func boolToString(b bool) string {
 	return "false"
 }
 
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// debugf logs only when the exporter runs with -log.level=debug.
+func debugf(logLevel string, format string, v ...interface{}) {
+	if logLevel == "debug" {
+		log.Printf(format, v...)
+	}
+}
+
 func parseRFC3339ToUnix(s string) (int64, error) {
 	t, err := time.Parse(time.RFC3339, s)
 	if err != nil {
@@ -555,10 +407,3 @@ func parseRFC3339ToUnix(s string) (int64, error) {
 	}
 	return t.Unix(), nil
 }
-
-func statusCodeSafe(resp *http.Response) int {
-	if resp == nil {
-		return 0
-	}
-	return resp.StatusCode
-}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -9,13 +12,131 @@ type Config struct {
 	Username     string
 	Password     string
 	Workspace    string // for Bitbucket Cloud
+
+	WebhookSecret string // HMAC secret shared with Bitbucket webhooks
+
+	StaleBranchDays []int // age thresholds for bitbucket_repo_stale_branches
+	StaleBranchTopN int   // number of oldest branches reported per repo, 0 disables
+
+	TrackedBranches []string // glob patterns of branches compared against the default branch
+
+	RequiredBranchPolicy map[string]int // rule -> minimum the default branch must be protected with
+
+	RepoRules map[string]string // repository setting -> expected value
+
+	DormantDays int // days without an authored commit or PR before a member counts as dormant
+
+	MirrorProbeHosts []string // smart mirror hosts whose own REST API is queried with the exporter's credentials
+
+	AuditCursorFile string   // where the audit log position is persisted, empty keeps it in memory
+	AuditActions    []string // glob patterns of audit actions counted by name
+
+	SecretVariablePatterns []string // glob patterns of Pipelines variable names that must be secured
+
+	SizeGrowthWindows []int  // windows in days for bitbucket_repo_size_growth_bytes_per_day
+	SizeHistoryFile   string // where repo size samples are persisted, empty keeps them in memory
+
+	RepoInventoryFile string // where the last repository inventory is persisted, empty keeps it in memory
 }
 
 func LoadConfig() (*Config, error) {
+	staleDays, err := intListEnv("BITBUCKET_STALE_BRANCH_DAYS", []int{30, 90, 180})
+	if err != nil {
+		return nil, err
+	}
+	topN, err := intEnv("BITBUCKET_STALE_BRANCH_TOP_N", 0)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parseBranchPolicy(os.Getenv("BITBUCKET_REQUIRED_BRANCH_POLICY"))
+	if err != nil {
+		return nil, fmt.Errorf("BITBUCKET_REQUIRED_BRANCH_POLICY: %v", err)
+	}
+	if len(policy) == 0 {
+		policy, _ = parseBranchPolicy(defaultBranchPolicy)
+	}
+	dormantDays, err := intEnv("BITBUCKET_DORMANT_DAYS", 90)
+	if err != nil {
+		return nil, err
+	}
+	growthWindows, err := intListEnv("BITBUCKET_SIZE_GROWTH_WINDOWS", []int{7, 30})
+	if err != nil {
+		return nil, err
+	}
+	repoRules, err := parseRepoRules(os.Getenv("BITBUCKET_REPO_RULES"))
+	if err != nil {
+		return nil, fmt.Errorf("BITBUCKET_REPO_RULES: %v", err)
+	}
 	return &Config{
 		BitbucketURL: os.Getenv("BITBUCKET_URL"),
 		Username:     os.Getenv("BITBUCKET_USERNAME"),
 		Password:     os.Getenv("BITBUCKET_PASSWORD"),
 		Workspace:    os.Getenv("BITBUCKET_WORKSPACE"),
+
+		WebhookSecret: os.Getenv("BITBUCKET_WEBHOOK_SECRET"),
+
+		StaleBranchDays: staleDays,
+		StaleBranchTopN: topN,
+
+		TrackedBranches: stringListEnv("BITBUCKET_TRACKED_BRANCHES"),
+
+		RequiredBranchPolicy: policy,
+
+		RepoRules: repoRules,
+
+		DormantDays: dormantDays,
+
+		MirrorProbeHosts: stringListEnv("BITBUCKET_MIRROR_PROBE_HOSTS"),
+
+		AuditCursorFile: os.Getenv("BITBUCKET_AUDIT_CURSOR_FILE"),
+		AuditActions:    stringListEnv("BITBUCKET_AUDIT_ACTIONS"),
+
+		SecretVariablePatterns: stringListEnv("BITBUCKET_SECRET_VARIABLE_PATTERNS"),
+
+		SizeGrowthWindows: growthWindows,
+		SizeHistoryFile:   os.Getenv("BITBUCKET_SIZE_HISTORY_FILE"),
+
+		RepoInventoryFile: os.Getenv("BITBUCKET_REPO_INVENTORY_FILE"),
 	}, nil
 }
+
+// intEnv reads an integer environment variable, falling back to def when unset.
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return n, nil
+}
+
+// intListEnv reads a comma-separated list of integers, falling back to def when unset.
+func intListEnv(name string, def []int) ([]int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	var out []int
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// stringListEnv reads a comma-separated list, dropping empty entries.
+func stringListEnv(name string) []string {
+	var out []string
+	for _, f := range strings.Split(os.Getenv(name), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
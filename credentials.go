@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// credential is an access token or key normalised across Cloud and Data Center.
+// Zero times mean the API does not report them.
+type credential struct {
+	Kind       string // access_token, ssh_key or deploy_key
+	Scope      string // project or repository
+	ProjectKey string
+	RepoSlug   string
+	ID         string
+	Name       string
+	Created    time.Time
+	LastUsed   time.Time
+	Expires    time.Time
+}
+
+// credentialLabels are the labels of the per-credential metrics.
+var credentialLabels = []string{"kind", "scope", "project_key", "repo_slug", "id", "name"}
+
+// dcExpiry returns when a Data Center token or key created at created expires
+// after expiryDays, the zero time if it never expires.
+func dcExpiry(created time.Time, expiryDays int) time.Time {
+	if expiryDays <= 0 || created.IsZero() {
+		return time.Time{}
+	}
+	return created.AddDate(0, 0, expiryDays)
+}
+
+// dcTime converts optional epoch milliseconds to a time.
+func dcTime(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// dcScope returns the credential scope and REST path of a Data Center project
+// (repoSlug empty) or repository.
+func dcScope(projectKey, repoSlug string) (scope, path string) {
+	scope, path = "project", "/projects/"+url.PathEscape(projectKey)
+	if repoSlug != "" {
+		scope, path = "repository", path+"/repos/"+url.PathEscape(repoSlug)
+	}
+	return scope, path
+}
+
+// serverAccessTokens lists the HTTP access tokens of a Data Center project
+// (repoSlug empty) or repository.
+func (c *BitbucketClient) serverAccessTokens(projectKey, repoSlug string) ([]credential, error) {
+	scope, path := dcScope(projectKey, repoSlug)
+	tokens, err := serverPages[struct {
+		ID                string `json:"id"`
+		Name              string `json:"name"`
+		CreatedDate       int64  `json:"createdDate"`
+		LastAuthenticated int64  `json:"lastAuthenticated"`
+		ExpiryDays        int    `json:"expiryDays"`
+	}](c, c.BaseURL+"/rest/access-tokens/latest"+path+"?limit=1000")
+	if err != nil {
+		return nil, err
+	}
+	var creds []credential
+	for _, t := range tokens {
+		created := dcTime(t.CreatedDate)
+		creds = append(creds, credential{"access_token", scope, projectKey, repoSlug, t.ID, t.Name, created, dcTime(t.LastAuthenticated), dcExpiry(created, t.ExpiryDays)})
+	}
+	return creds, nil
+}
+
+// serverAccessKeys lists the SSH access keys of a Data Center project
+// (repoSlug empty) or repository.
+func (c *BitbucketClient) serverAccessKeys(projectKey, repoSlug string) ([]credential, error) {
+	scope, path := dcScope(projectKey, repoSlug)
+	keys, err := serverPages[struct {
+		Key struct {
+			ID                int    `json:"id"`
+			Label             string `json:"label"`
+			CreatedDate       int64  `json:"createdDate"`
+			LastAuthenticated int64  `json:"lastAuthenticated"`
+			ExpiryDays        int    `json:"expiryDays"`
+		} `json:"key"`
+	}](c, c.BaseURL+"/rest/keys/latest"+path+"/ssh?limit=1000")
+	if err != nil {
+		return nil, err
+	}
+	var creds []credential
+	for _, k := range keys {
+		created := dcTime(k.Key.CreatedDate)
+		creds = append(creds, credential{"ssh_key", scope, projectKey, repoSlug, fmt.Sprint(k.Key.ID), k.Key.Label, created, dcTime(k.Key.LastAuthenticated), dcExpiry(created, k.Key.ExpiryDays)})
+	}
+	return creds, nil
+}
+
+// cloudDeployKeys lists the deploy keys of a Cloud repository. Cloud deploy keys never expire.
+func (c *BitbucketClient) cloudDeployKeys(repo Repository) ([]credential, error) {
+	values, err := cloudPages[struct {
+		ID        int    `json:"id"`
+		Label     string `json:"label"`
+		CreatedOn string `json:"created_on"`
+		LastUsed  string `json:"last_used"`
+	}](c, c.repoPath(repo)+"/deploy-keys?pagelen=100")
+	if err != nil {
+		return nil, err
+	}
+	var creds []credential
+	for _, v := range values {
+		created, _ := time.Parse(time.RFC3339, v.CreatedOn)
+		lastUsed, _ := time.Parse(time.RFC3339, v.LastUsed)
+		creds = append(creds, credential{"deploy_key", "repository", repo.ProjectKey, repo.Slug, fmt.Sprint(v.ID), v.Label, created, lastUsed, time.Time{}})
+	}
+	return creds, nil
+}
+
+// serverCredentials lists the HTTP access tokens and access keys of a Data
+// Center project (repoSlug empty) or repository. Each kind is read on its
+// own, so one failing endpoint does not hide the other kind.
+func (c *BitbucketCollector) serverCredentials(projectKey, repoSlug string) []credential {
+	name := projectKey + "/" + repoSlug
+	if repoSlug == "" {
+		name = "project " + projectKey
+	}
+	tokens, err := c.client.serverAccessTokens(projectKey, repoSlug)
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch access tokens of %s: %v", name, err)
+	}
+	keys, err := c.client.serverAccessKeys(projectKey, repoSlug)
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch access keys of %s: %v", name, err)
+	}
+	return append(tokens, keys...)
+}
+
+// repoCredentials lists the tokens and keys of one repository for its
+// snapshot: deploy keys on Cloud, access tokens and access keys on Data
+// Center. Cloud access tokens are not listable through the REST API.
+func (c *BitbucketCollector) repoCredentials(repo Repository) []credential {
+	if !c.client.Cloud {
+		return c.serverCredentials(repo.ProjectKey, repo.Slug)
+	}
+	keys, err := c.client.cloudDeployKeys(repo)
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch deploy keys for %s: %v", repo.Slug, err)
+	}
+	return keys
+}
+
+// refreshProjectCredentials re-reads the tokens and keys of every Data
+// Center project; it runs with each full refresh cycle.
+func (c *BitbucketCollector) refreshProjectCredentials() {
+	if c.client.Cloud {
+		return
+	}
+	keys, err := c.client.ListProjectKeys()
+	if err != nil {
+		log.Printf("error listing projects for credentials: %v", err)
+		return
+	}
+	var creds []credential
+	for _, key := range keys {
+		creds = append(creds, c.serverCredentials(key, "")...)
+	}
+	c.snapshotMu.Lock()
+	c.projectCredentials = creds
+	c.snapshotMu.Unlock()
+}
+
+// collectCredentials reports the expiry, age and last use of creds. Ages are
+// measured at collection time, not when the credentials were fetched.
+func (c *BitbucketCollector) collectCredentials(ch chan<- prometheus.Metric, creds []credential) {
+	now := time.Now()
+	// Every kind the flavor has is reported, so the last long-lived key going away is a 0 rather than a missing series.
+	withoutExpiry := map[string]int{"deploy_key": 0}
+	if !c.client.Cloud {
+		withoutExpiry = map[string]int{"access_token": 0, "ssh_key": 0}
+	}
+	for _, cr := range creds {
+		labels := []string{cr.Kind, cr.Scope, cr.ProjectKey, cr.RepoSlug, cr.ID, cr.Name}
+		if cr.Expires.IsZero() {
+			withoutExpiry[cr.Kind]++
+		} else {
+			ch <- prometheus.MustNewConstMetric(c.credentialExpiry, prometheus.GaugeValue, float64(cr.Expires.Unix()), labels...)
+		}
+		if !cr.Created.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.credentialAge, prometheus.GaugeValue, now.Sub(cr.Created).Seconds(), labels...)
+		}
+		if !cr.LastUsed.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.credentialLastUsedAge, prometheus.GaugeValue, now.Sub(cr.LastUsed).Seconds(), labels...)
+		}
+	}
+	for kind, n := range withoutExpiry {
+		ch <- prometheus.MustNewConstMetric(c.credentialsNoExpiry, prometheus.GaugeValue, float64(n), kind)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshotMetrics runs a full refresh cycle over repos and returns what collectSnapshots emits.
+func snapshotMetrics(c *BitbucketCollector, repos []Repository) staticCollector {
+	c.refreshAll(repos)
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.collectSnapshots(ch)
+		close(ch)
+	}()
+	var metrics staticCollector
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func TestCredentials_DataCenter(t *testing.T) {
+	created := time.Now().AddDate(0, 0, -10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects":
+			body = page(map[string]string{"key": "PRJ"})
+		case "/rest/access-tokens/latest/projects/PRJ":
+			body = page(
+				map[string]interface{}{"id": "t1", "name": "ci", "createdDate": created.UnixMilli(), "expiryDays": 90, "lastAuthenticated": time.Now().Add(-time.Hour).UnixMilli()},
+				map[string]interface{}{"id": "t2", "name": "forever", "createdDate": created.UnixMilli()},
+			)
+		case "/rest/keys/latest/projects/PRJ/repos/app/ssh":
+			body = page(map[string]interface{}{"key": map[string]interface{}{"id": 7, "label": "deploy", "createdDate": created.UnixMilli()}})
+		case "/rest/keys/latest/projects/PRJ/ssh", "/rest/access-tokens/latest/projects/PRJ/repos/app":
+			// Each kind fails on one scope; the other kind must still be reported.
+			w.WriteHeader(http.StatusForbidden)
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+	c := NewBitbucketCollector(NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false), &Config{}, "info", 0)
+
+	out := scrape(t, snapshotMetrics(c, []Repository{{ProjectKey: "PRJ", Slug: "app"}}))
+	for _, want := range []string{
+		`bitbucket_credential_expiry_timestamp{id="t1",kind="access_token",name="ci",project_key="PRJ",repo_slug="",scope="project"}`,
+		`bitbucket_credential_last_used_age_seconds{id="t1",kind="access_token",name="ci",project_key="PRJ",repo_slug="",scope="project"} 3600`,
+		`bitbucket_credential_age_seconds{id="7",kind="ssh_key",name="deploy",project_key="PRJ",repo_slug="app",scope="repository"} 864000`,
+		`bitbucket_credentials_without_expiry_total{kind="access_token"} 1`,
+		`bitbucket_credentials_without_expiry_total{kind="ssh_key"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestCredentials_CloudDeployKeys(t *testing.T) {
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2.0/repositories/testws/app/deploy-keys" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+			map[string]interface{}{"id": 3, "label": "builder", "created_on": time.Now().AddDate(0, 0, -1).UTC().Format(time.RFC3339), "last_used": time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)},
+			map[string]interface{}{"id": 4, "label": "unused", "created_on": time.Now().AddDate(0, 0, -2).UTC().Format(time.RFC3339)},
+		}})
+	}))
+	c := NewBitbucketCollector(client, &Config{}, "info", 0)
+
+	out := scrape(t, snapshotMetrics(c, []Repository{{ProjectKey: "PRJ", Slug: "app"}}))
+	for _, want := range []string{
+		`bitbucket_credential_age_seconds{id="3",kind="deploy_key",name="builder",project_key="PRJ",repo_slug="app",scope="repository"} 86400`,
+		`bitbucket_credential_last_used_age_seconds{id="3",kind="deploy_key",name="builder",project_key="PRJ",repo_slug="app",scope="repository"} 60`,
+		`bitbucket_credentials_without_expiry_total{kind="deploy_key"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `bitbucket_credential_last_used_age_seconds{id="4"`) {
+		t.Errorf("never used key reported a last use\n%s", out)
+	}
+}
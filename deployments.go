@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// productionEnvironmentType is the Bitbucket environment type DORA metrics are computed for.
+const productionEnvironmentType = "Production"
+
+// deploymentDurationBuckets cover quick config pushes up to long blue/green rollouts.
+var deploymentDurationBuckets = []float64{30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// cloudEnvironment is the subset of a Bitbucket Cloud deployment environment the exporter reads.
+type cloudEnvironment struct {
+	UUID            string `json:"uuid"`
+	Name            string `json:"name"`
+	EnvironmentType struct {
+		Name string `json:"name"`
+	} `json:"environment_type"`
+}
+
+// cloudDeployment is the subset of a Bitbucket Cloud deployment the exporter reads.
+type cloudDeployment struct {
+	UUID  string `json:"uuid"`
+	State struct {
+		Name   string `json:"name"`
+		Status struct {
+			Name string `json:"name"`
+		} `json:"status"`
+		StartedOn   string `json:"started_on"`
+		CompletedOn string `json:"completed_on"`
+	} `json:"state"`
+	Environment struct {
+		UUID string `json:"uuid"`
+	} `json:"environment"`
+	Release struct {
+		Commit struct {
+			Hash string `json:"hash"`
+		} `json:"commit"`
+	} `json:"release"`
+	Deployable struct {
+		Commit struct {
+			Hash string `json:"hash"`
+		} `json:"commit"`
+	} `json:"deployable"`
+}
+
+// commit returns the hash that was deployed.
+func (d cloudDeployment) commit() string {
+	if d.Release.Commit.Hash != "" {
+		return d.Release.Commit.Hash
+	}
+	return d.Deployable.Commit.Hash
+}
+
+// environmentDeployment is the latest successful deployment seen for an environment.
+type environmentDeployment struct {
+	name        string
+	envType     string
+	completedAt time.Time
+	commit      string
+}
+
+// DeploymentCollector tracks Bitbucket Cloud Deployments. Finished deployments
+// are counted once as they appear in the most recent page of history, and the
+// latest successful deployment per environment is remembered across scrapes.
+type DeploymentCollector struct {
+	client   *BitbucketClient
+	logLevel string
+
+	mu      sync.Mutex
+	counted map[string]map[string]bool                   // repo slug -> deployment uuid
+	latest  map[string]map[string]*environmentDeployment // repo slug -> environment uuid
+
+	deploymentsTotal  *prometheus.CounterVec
+	durationSeconds   *prometheus.HistogramVec
+	lastSuccessTime   *prometheus.Desc
+	environmentCommit *prometheus.Desc
+
+	dora *doraTracker
+}
+
+func NewDeploymentCollector(client *BitbucketClient, logLevel string) *DeploymentCollector {
+	return &DeploymentCollector{
+		client:   client,
+		logLevel: logLevel,
+		counted:  make(map[string]map[string]bool),
+		latest:   make(map[string]map[string]*environmentDeployment),
+		deploymentsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_deployments_total",
+			Help: "Number of finished deployments by state and environment",
+		}, []string{"repo_slug", "environment", "environment_type", "state"}),
+		durationSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_deployment_duration_seconds",
+			Help:    "Duration of finished deployments",
+			Buckets: deploymentDurationBuckets,
+		}, []string{"repo_slug", "environment_type"}),
+		lastSuccessTime:   prometheus.NewDesc("bitbucket_deployment_last_success_timestamp", "Unix timestamp of the last successful deployment per environment", []string{"repo_slug", "environment", "environment_type"}, nil),
+		environmentCommit: prometheus.NewDesc("bitbucket_deployment_environment_commit_info", "Commit currently deployed to each environment", []string{"repo_slug", "environment", "environment_type", "commit"}, nil),
+		dora:              newDoraTracker(client, logLevel),
+	}
+}
+
+func (c *DeploymentCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.deploymentsTotal.Describe(ch)
+	c.durationSeconds.Describe(ch)
+	ch <- c.lastSuccessTime
+	ch <- c.environmentCommit
+	c.dora.describe(ch)
+}
+
+func (c *DeploymentCollector) Collect(ch chan<- prometheus.Metric) {
+	// Deployments are a Bitbucket Cloud Pipelines feature.
+	if !c.client.Cloud {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		log.Printf("error listing repositories for deployments: %v", err)
+	}
+	for _, repo := range repos {
+		if err := c.scanRepo(repo); err != nil {
+			debugf(c.logLevel, "Failed to fetch deployments for %s: %v", repo.Slug, err)
+		}
+		for _, env := range c.latest[repo.Slug] {
+			ch <- prometheus.MustNewConstMetric(c.lastSuccessTime, prometheus.GaugeValue, float64(env.completedAt.Unix()), repo.Slug, env.name, env.envType)
+			ch <- prometheus.MustNewConstMetric(c.environmentCommit, prometheus.GaugeValue, 1, repo.Slug, env.name, env.envType, env.commit)
+		}
+	}
+	c.deploymentsTotal.Collect(ch)
+	c.durationSeconds.Collect(ch)
+	c.dora.collect(ch)
+}
+
+// scanRepo reads the repo's environments and its most recent deployments,
+// counting the finished ones that were not seen on a previous scrape.
+func (c *DeploymentCollector) scanRepo(repo Repository) error {
+	slug := repo.Slug
+	base := fmt.Sprintf("%s/repositories/%s/%s", cloudAPIURL, c.client.Workspace, slug)
+	envs, err := cloudPages[cloudEnvironment](c.client, base+"/environments/?pagelen=100")
+	if err != nil {
+		return err
+	}
+	envByUUID := make(map[string]cloudEnvironment)
+	for _, e := range envs {
+		envByUUID[e.UUID] = e
+	}
+
+	var page struct {
+		Values []cloudDeployment `json:"values"`
+	}
+	if err := c.client.getJSON(base+"/deployments/?sort=-state.started_on&pagelen=100", &page); err != nil {
+		return err
+	}
+
+	prev, seen := c.counted[slug]
+	counted := make(map[string]bool)
+	if c.latest[slug] == nil {
+		c.latest[slug] = make(map[string]*environmentDeployment)
+	}
+	var finished []cloudDeployment
+	for _, d := range page.Values {
+		if d.State.Name != "COMPLETED" {
+			continue
+		}
+		// Only deployments still on the page are remembered; older ones cannot reappear.
+		counted[d.UUID] = true
+		if !prev[d.UUID] {
+			finished = append(finished, d)
+		}
+	}
+	// Oldest first, so that per-environment history is replayed in order.
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].State.CompletedOn < finished[j].State.CompletedOn
+	})
+	for _, d := range finished {
+		env := envByUUID[d.Environment.UUID]
+		status := d.State.Status.Name
+		c.deploymentsTotal.WithLabelValues(slug, env.Name, env.EnvironmentType.Name, status).Inc()
+		started, errS := time.Parse(time.RFC3339, d.State.StartedOn)
+		completed, errC := time.Parse(time.RFC3339, d.State.CompletedOn)
+		if errS == nil && errC == nil {
+			c.durationSeconds.WithLabelValues(slug, env.EnvironmentType.Name).Observe(completed.Sub(started).Seconds())
+		}
+		if errC != nil {
+			continue
+		}
+		last := c.latest[slug][d.Environment.UUID]
+		if env.EnvironmentType.Name == productionEnvironmentType {
+			c.dora.observe(repo, d, completed, last, !seen)
+		}
+		if status == "SUCCESSFUL" && (last == nil || completed.After(last.completedAt)) {
+			c.latest[slug][d.Environment.UUID] = &environmentDeployment{env.Name, env.EnvironmentType.Name, completed, d.commit()}
+		}
+	}
+	c.counted[slug] = counted
+
+	// The shared page covers every environment, so a quiet one can fall off it;
+	// its last success is read on its own.
+	for _, env := range envs {
+		var last struct {
+			Values []cloudDeployment `json:"values"`
+		}
+		u := base + "/deployments/?environment=" + url.QueryEscape(env.UUID) + "&state.status.name=SUCCESSFUL&sort=-state.completed_on&pagelen=1"
+		if err := c.client.getJSON(u, &last); err != nil {
+			debugf(c.logLevel, "Failed to fetch last deployment to %s in %s: %v", env.Name, slug, err)
+			continue
+		}
+		if len(last.Values) == 0 {
+			continue
+		}
+		d := last.Values[0]
+		if d.State.Status.Name != "SUCCESSFUL" {
+			continue
+		}
+		completed, err := time.Parse(time.RFC3339, d.State.CompletedOn)
+		if err != nil {
+			continue
+		}
+		if l := c.latest[slug][env.UUID]; l == nil || completed.After(l.completedAt) {
+			c.latest[slug][env.UUID] = &environmentDeployment{env.Name, env.EnvironmentType.Name, completed, d.commit()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDeploymentCollector_CountsAndKeepsQuietEnvironments(t *testing.T) {
+	deployment := func(uuid, env, status, started, completed, commit string) map[string]interface{} {
+		return map[string]interface{}{
+			"uuid":        uuid,
+			"environment": map[string]string{"uuid": env},
+			"state": map[string]interface{}{
+				"name": "COMPLETED", "status": map[string]string{"name": status},
+				"started_on": started, "completed_on": completed,
+			},
+			"release": map[string]interface{}{"commit": map[string]string{"hash": commit}},
+		}
+	}
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2.0/repositories/testws":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"slug": "app", "name": "App", "project": map[string]interface{}{"key": "PRJ"}},
+			}})
+		case "/2.0/repositories/testws/app/environments/":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"uuid": "{stg}", "name": "staging", "environment_type": map[string]string{"name": "Staging"}},
+				map[string]interface{}{"uuid": "{prd}", "name": "production", "environment_type": map[string]string{"name": "Production"}},
+			}})
+		case "/2.0/repositories/testws/app/deployments/":
+			var values []interface{}
+			switch r.URL.Query().Get("environment") {
+			case "":
+				// The shared page only holds recent staging deployments.
+				values = []interface{}{
+					deployment("{d3}", "{stg}", "SUCCESSFUL", "2024-05-02T10:00:00Z", "2024-05-02T10:02:00Z", "ccc"),
+					deployment("{d2}", "{stg}", "FAILED", "2024-05-01T10:00:00Z", "2024-05-01T10:01:00Z", "bbb"),
+				}
+			case "{stg}":
+				// The status filter is not honoured; a newer failure comes back.
+				values = []interface{}{deployment("{d4}", "{stg}", "FAILED", "2024-05-03T10:00:00Z", "2024-05-03T10:01:00Z", "zzz")}
+			case "{prd}":
+				values = []interface{}{deployment("{d1}", "{prd}", "SUCCESSFUL", "2024-03-01T10:00:00Z", "2024-03-01T10:05:00Z", "aaa")}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": values})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	c := NewDeploymentCollector(client, "info")
+
+	scrape(t, c)
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_deployments_total{environment="staging",environment_type="Staging",repo_slug="app",state="SUCCESSFUL"} 1`,
+		`bitbucket_deployments_total{environment="staging",environment_type="Staging",repo_slug="app",state="FAILED"} 1`,
+		`bitbucket_deployment_duration_seconds_sum{environment_type="Staging",repo_slug="app"} 180`,
+		`bitbucket_deployment_last_success_timestamp{environment="staging",environment_type="Staging",repo_slug="app"} 1.71464412e+09`,
+		`bitbucket_deployment_last_success_timestamp{environment="production",environment_type="Production",repo_slug="app"} 1.7092875e+09`,
+		`bitbucket_deployment_environment_commit_info{commit="aaa",environment="production",environment_type="Production",repo_slug="app"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `commit="zzz"`) {
+		t.Errorf("failed deployment reported as the last success\n%s", out)
+	}
+}
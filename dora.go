@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// doraMaxCommitPages caps how much of a deployment's commit range is walked for lead time.
+const doraMaxCommitPages = 5
+
+// doraLeadTimeBuckets span one hour up to a month.
+var doraLeadTimeBuckets = []float64{3600, 4 * 3600, 86400, 2 * 86400, 7 * 86400, 14 * 86400, 30 * 86400}
+
+// doraRestoreBuckets span ten minutes up to a week.
+var doraRestoreBuckets = []float64{600, 1800, 3600, 4 * 3600, 86400, 7 * 86400}
+
+// cloudCommit is the subset of a Bitbucket Cloud commit object DORA metrics read.
+type cloudCommit struct {
+	Hash    string `json:"hash"`
+	Date    string `json:"date"`
+	Message string `json:"message"`
+}
+
+// isRevert reports whether the commit was created by `git revert`.
+func (c cloudCommit) isRevert() bool {
+	return strings.HasPrefix(c.Message, `Revert "`)
+}
+
+// doraTracker computes the DORA four keys from production deployments as the
+// DeploymentCollector discovers them, oldest first.
+type doraTracker struct {
+	client   *BitbucketClient
+	logLevel string
+
+	failingSince map[string]time.Time // repo slug + environment uuid
+
+	deploymentsTotal    *prometheus.CounterVec
+	leadTimeSeconds     *prometheus.HistogramVec
+	changeFailuresTotal *prometheus.CounterVec
+	restoreSeconds      *prometheus.HistogramVec
+}
+
+func newDoraTracker(client *BitbucketClient, logLevel string) *doraTracker {
+	return &doraTracker{
+		client:       client,
+		logLevel:     logLevel,
+		failingSince: make(map[string]time.Time),
+		deploymentsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_dora_deployments_total",
+			Help: "Number of finished production deployments by result",
+		}, []string{"project_key", "repo_slug", "result"}),
+		leadTimeSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_dora_lead_time_seconds",
+			Help:    "Time from the first commit of a change to its successful production deployment",
+			Buckets: doraLeadTimeBuckets,
+		}, []string{"project_key", "repo_slug"}),
+		changeFailuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_dora_change_failures_total",
+			Help: "Number of production changes that failed, by reason",
+		}, []string{"project_key", "repo_slug", "reason"}),
+		restoreSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_dora_time_to_restore_seconds",
+			Help:    "Time from a failed production deployment to the next successful one",
+			Buckets: doraRestoreBuckets,
+		}, []string{"project_key", "repo_slug"}),
+	}
+}
+
+func (t *doraTracker) describe(ch chan<- *prometheus.Desc) {
+	t.deploymentsTotal.Describe(ch)
+	t.leadTimeSeconds.Describe(ch)
+	t.changeFailuresTotal.Describe(ch)
+	t.restoreSeconds.Describe(ch)
+}
+
+func (t *doraTracker) collect(ch chan<- prometheus.Metric) {
+	t.deploymentsTotal.Collect(ch)
+	t.leadTimeSeconds.Collect(ch)
+	t.changeFailuresTotal.Collect(ch)
+	t.restoreSeconds.Collect(ch)
+}
+
+// observe records a finished production deployment. last is the previous
+// successful deployment to the same environment, if known. Lead time is not
+// computed while backfilling a repo seen for the first time, to avoid walking
+// its whole deployment history in one scrape.
+func (t *doraTracker) observe(repo Repository, d cloudDeployment, completed time.Time, last *environmentDeployment, backfill bool) {
+	status := d.State.Status.Name
+	t.deploymentsTotal.WithLabelValues(repo.ProjectKey, repo.Slug, status).Inc()
+
+	key := repo.Slug + "/" + d.Environment.UUID
+	switch status {
+	case "FAILED":
+		t.changeFailuresTotal.WithLabelValues(repo.ProjectKey, repo.Slug, "failed_deployment").Inc()
+		if _, failing := t.failingSince[key]; !failing {
+			t.failingSince[key] = completed
+		}
+	case "SUCCESSFUL":
+		if since, failing := t.failingSince[key]; failing {
+			t.restoreSeconds.WithLabelValues(repo.ProjectKey, repo.Slug).Observe(completed.Sub(since).Seconds())
+			delete(t.failingSince, key)
+		}
+		if backfill || last == nil || last.commit == d.commit() {
+			return
+		}
+		if err := t.observeLeadTime(repo, d.commit(), last.commit, completed); err != nil {
+			debugf(t.logLevel, "Failed to compute lead time for %s deployment %s: %v", repo.Slug, d.UUID, err)
+		}
+	}
+}
+
+// observeLeadTime walks the commits deployed between base and head. Each pull
+// request merged in that range contributes one lead time measured from its
+// first commit; commits pushed without a pull request contribute their own
+// date. Revert commits in the range count as change failures.
+func (t *doraTracker) observeLeadTime(repo Repository, head, base string, deployedAt time.Time) error {
+	repoURL := fmt.Sprintf("%s/repositories/%s/%s", cloudAPIURL, t.client.Workspace, repo.Slug)
+	next := repoURL + "/commits/" + url.PathEscape(head) + "?exclude=" + url.QueryEscape(base) + "&pagelen=100"
+	var commits []cloudCommit
+	for page := 0; next != "" && page < doraMaxCommitPages; page++ {
+		var data struct {
+			Values []cloudCommit `json:"values"`
+			Next   string        `json:"next"`
+		}
+		if err := t.client.getJSON(next, &data); err != nil {
+			return err
+		}
+		commits = append(commits, data.Values...)
+		next = data.Next
+	}
+
+	seenPRs := make(map[int]bool)
+	for _, commit := range commits {
+		if commit.isRevert() {
+			t.changeFailuresTotal.WithLabelValues(repo.ProjectKey, repo.Slug, "revert").Inc()
+		}
+		var prs struct {
+			Values []struct {
+				ID int `json:"id"`
+			} `json:"values"`
+		}
+		if err := t.client.getJSON(repoURL+"/commit/"+commit.Hash+"/pullrequests?pagelen=50", &prs); err != nil || len(prs.Values) == 0 {
+			if ts, err := time.Parse(time.RFC3339, commit.Date); err == nil {
+				t.leadTimeSeconds.WithLabelValues(repo.ProjectKey, repo.Slug).Observe(deployedAt.Sub(ts).Seconds())
+			}
+			continue
+		}
+		for _, pr := range prs.Values {
+			if seenPRs[pr.ID] {
+				continue
+			}
+			seenPRs[pr.ID] = true
+			prCommits, err := cloudPages[cloudCommit](t.client, fmt.Sprintf("%s/pullrequests/%d/commits?pagelen=100", repoURL, pr.ID))
+			if err != nil {
+				debugf(t.logLevel, "Failed to fetch commits of PR %d in %s: %v", pr.ID, repo.Slug, err)
+				continue
+			}
+			var first time.Time
+			for _, pc := range prCommits {
+				if ts, err := time.Parse(time.RFC3339, pc.Date); err == nil && (first.IsZero() || ts.Before(first)) {
+					first = ts
+				}
+			}
+			if !first.IsZero() {
+				t.leadTimeSeconds.WithLabelValues(repo.ProjectKey, repo.Slug).Observe(deployedAt.Sub(first).Seconds())
+			}
+		}
+	}
+	return nil
+}
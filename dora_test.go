@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDoraTracker_ProductionDeployments(t *testing.T) {
+	deployment := func(uuid, status, started, completed, commit string) map[string]interface{} {
+		return map[string]interface{}{
+			"uuid":        uuid,
+			"state":       map[string]interface{}{"name": "COMPLETED", "status": map[string]interface{}{"name": status}, "started_on": started, "completed_on": completed},
+			"environment": map[string]interface{}{"uuid": "{prod}"},
+			"release":     map[string]interface{}{"commit": map[string]interface{}{"hash": commit}},
+		}
+	}
+	deployments := []interface{}{
+		deployment("{d2}", "SUCCESSFUL", "2024-07-01T11:00:00+00:00", "2024-07-01T11:05:00+00:00", "aaa"),
+		deployment("{d1}", "FAILED", "2024-07-01T10:00:00+00:00", "2024-07-01T10:05:00+00:00", "aaa"),
+	}
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		switch r.URL.Path {
+		case "/2.0/repositories/testws":
+			enc.Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"slug": "app", "project": map[string]interface{}{"key": "PRJ"}},
+			}})
+		case "/2.0/repositories/testws/app/environments/":
+			enc.Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"uuid": "{prod}", "name": "prod", "environment_type": map[string]interface{}{"name": "Production"}},
+			}})
+		case "/2.0/repositories/testws/app/deployments/":
+			enc.Encode(map[string]interface{}{"values": deployments})
+		case "/2.0/repositories/testws/app/commits/bbb":
+			if r.URL.Query().Get("exclude") != "aaa" {
+				t.Errorf("unexpected commit range exclude=%q", r.URL.Query().Get("exclude"))
+			}
+			enc.Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"hash": "bbb", "date": "2024-07-02T09:00:00+00:00", "message": "Revert \"feature\""},
+			}})
+		case "/2.0/repositories/testws/app/commit/bbb/pullrequests":
+			enc.Encode(map[string]interface{}{"values": []interface{}{map[string]interface{}{"id": 7}}})
+		case "/2.0/repositories/testws/app/pullrequests/7/commits":
+			enc.Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"hash": "bbb", "date": "2024-07-02T09:00:00+00:00"},
+				map[string]interface{}{"hash": "ccc", "date": "2024-07-02T08:00:00+00:00"},
+			}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	c := NewDeploymentCollector(client, "info")
+
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_dora_deployments_total{project_key="PRJ",repo_slug="app",result="FAILED"} 1`,
+		`bitbucket_dora_change_failures_total{project_key="PRJ",reason="failed_deployment",repo_slug="app"} 1`,
+		`bitbucket_dora_time_to_restore_seconds_sum{project_key="PRJ",repo_slug="app"} 3600`,
+		`bitbucket_deployment_environment_commit_info{commit="aaa",environment="prod",environment_type="Production",repo_slug="app"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("first scrape missing %q", want)
+		}
+	}
+	if strings.Contains(out, "bitbucket_dora_lead_time_seconds_count") {
+		t.Errorf("lead time must not be computed while backfilling")
+	}
+
+	deployments = append([]interface{}{deployment("{d3}", "SUCCESSFUL", "2024-07-02T09:55:00+00:00", "2024-07-02T10:00:00+00:00", "bbb")}, deployments...)
+	out = scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_dora_deployments_total{project_key="PRJ",repo_slug="app",result="SUCCESSFUL"} 2`,
+		`bitbucket_dora_lead_time_seconds_sum{project_key="PRJ",repo_slug="app"} 7200`,
+		`bitbucket_dora_lead_time_seconds_count{project_key="PRJ",repo_slug="app"} 1`,
+		`bitbucket_dora_change_failures_total{project_key="PRJ",reason="revert",repo_slug="app"} 1`,
+		`bitbucket_deployment_environment_commit_info{commit="bbb",environment="prod",environment_type="Production",repo_slug="app"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("second scrape missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusClient reads /status. A node that hangs must show as UNREACHABLE
+// rather than stall the scrape.
+var statusClient = &http.Client{Timeout: 10 * time.Second}
+
+// serverStates are the application states reported by the Data Center /status endpoint,
+// plus UNREACHABLE when the endpoint cannot be read.
+var serverStates = []string{"STARTING", "FIRST_RUN", "RUNNING", "MAINTENANCE", "ERROR", "STOPPING", "UNREACHABLE"}
+
+// healthComponents are the optional Data Center subsystems probed for health.
+// Endpoints that answer 404 are not exposed by the instance and are skipped.
+// Mirroring is judged from the mirror servers instead, see mirrorsHealthy.
+var healthComponents = []struct {
+	name string
+	path string
+}{
+	{"search", "/rest/indexing/latest/status"},
+	{"mesh", "/rest/api/1.0/admin/git/mesh/nodes"},
+}
+
+// serverState reads the unauthenticated /status endpoint.
+func (c *BitbucketClient) serverState() (string, error) {
+	var status struct {
+		State string `json:"state"`
+	}
+	// /status answers 503 with a body while starting or in maintenance, so the status code is not checked.
+	resp, err := statusClient.Get(c.BaseURL + "/status")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", err
+	}
+	return status.State, nil
+}
+
+// collectServerHealth reports the application state, cluster membership and
+// the health of search, mesh and mirroring on Data Center. Mirroring is
+// healthy when every enabled mirror has been seen by the upstream recently.
+func (c *BitbucketCollector) collectServerHealth(ch chan<- prometheus.Metric) {
+	state, err := c.client.serverState()
+	if err != nil {
+		debugf(c.logLevel, "Failed to read server status: %v", err)
+		state = "UNREACHABLE"
+	}
+	for _, s := range serverStates {
+		ch <- prometheus.MustNewConstMetric(c.serverStatus, prometheus.GaugeValue, boolToFloat(s == state), s)
+	}
+
+	var cluster struct {
+		Running bool `json:"running"`
+		Nodes   []struct {
+			ID      string `json:"id"`
+			Name    string `json:"name"`
+			Address struct {
+				HostName string `json:"hostName"`
+			} `json:"address"`
+			Local bool `json:"local"`
+		} `json:"nodes"`
+	}
+	if err := c.client.getJSON(c.client.BaseURL+"/rest/api/1.0/admin/cluster", &cluster); err != nil {
+		debugf(c.logLevel, "Failed to fetch cluster nodes: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.clusterNodesTotal, prometheus.GaugeValue, float64(len(cluster.Nodes)))
+		for _, n := range cluster.Nodes {
+			ch <- prometheus.MustNewConstMetric(c.clusterNodeInfo, prometheus.GaugeValue, 1, n.ID, n.Name, n.Address.HostName, boolToString(n.Local))
+		}
+		ch <- prometheus.MustNewConstMetric(c.componentHealthy, prometheus.GaugeValue, boolToFloat(cluster.Running), "cluster")
+	}
+
+	for _, comp := range healthComponents {
+		var body struct {
+			Values []struct {
+				State string `json:"state"`
+			} `json:"values"`
+		}
+		err := c.client.getJSON(c.client.BaseURL+comp.path, &body)
+		if err == statusError(http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			debugf(c.logLevel, "Health check of %s failed: %v", comp.name, err)
+		}
+		healthy := err == nil
+		if comp.name == "mesh" && healthy {
+			states := make(map[string]int)
+			for _, n := range body.Values {
+				states[n.State]++
+			}
+			for state, n := range states {
+				ch <- prometheus.MustNewConstMetric(c.meshNodes, prometheus.GaugeValue, float64(n), state)
+			}
+			healthy = len(body.Values) > 0 && states["AVAILABLE"] == len(body.Values)
+		}
+		ch <- prometheus.MustNewConstMetric(c.componentHealthy, prometheus.GaugeValue, boolToFloat(healthy), comp.name)
+	}
+
+	mirrors, err := serverPages[mirrorServer](c.client, c.client.BaseURL+"/rest/mirroring/1.0/mirrorServers?limit=100")
+	if err == statusError(http.StatusNotFound) {
+		return
+	}
+	if err != nil {
+		debugf(c.logLevel, "Health check of mirroring failed: %v", err)
+		ch <- prometheus.MustNewConstMetric(c.componentHealthy, prometheus.GaugeValue, 0, "mirroring")
+		return
+	}
+	if healthy, ok := mirrorsHealthy(mirrors, time.Now()); ok {
+		ch <- prometheus.MustNewConstMetric(c.componentHealthy, prometheus.GaugeValue, boolToFloat(healthy), "mirroring")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// healthMetrics runs collectServerHealth against a Data Center server at url.
+func healthMetrics(url string) staticCollector {
+	c := NewBitbucketCollector(NewBitbucketClient(&Config{BitbucketURL: url}, false), &Config{}, "info", 0)
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.collectServerHealth(ch)
+		close(ch)
+	}()
+	var metrics staticCollector
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func TestCollectServerHealth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"state":"MAINTENANCE"}`))
+		case "/rest/api/1.0/admin/cluster":
+			json.NewEncoder(w).Encode(map[string]interface{}{"running": true, "nodes": []interface{}{
+				map[string]interface{}{"id": "n1", "name": "node-1", "address": map[string]string{"hostName": "10.0.0.1"}, "local": true},
+				map[string]interface{}{"id": "n2", "name": "node-2", "address": map[string]string{"hostName": "10.0.0.2"}},
+			}})
+		case "/rest/api/1.0/admin/git/mesh/nodes":
+			json.NewEncoder(w).Encode(page(map[string]string{"state": "AVAILABLE"}, map[string]string{"state": "OFFLINE"}))
+		case "/rest/indexing/latest/status":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	out := scrape(t, healthMetrics(ts.URL))
+	for _, want := range []string{
+		`bitbucket_server_status{state="MAINTENANCE"} 1`,
+		`bitbucket_server_status{state="RUNNING"} 0`,
+		`bitbucket_cluster_nodes_total 2`,
+		`bitbucket_cluster_node_info{address="10.0.0.1",local="true",name="node-1",node_id="n1"} 1`,
+		`bitbucket_component_healthy{component="cluster"} 1`,
+		`bitbucket_component_healthy{component="search"} 0`,
+		`bitbucket_component_healthy{component="mesh"} 0`,
+		`bitbucket_mesh_nodes{state="OFFLINE"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q", want)
+		}
+	}
+	if strings.Contains(out, `component="mirroring"`) {
+		t.Errorf("mirroring is not exposed and should be skipped")
+	}
+}
+
+func TestCollectServerHealth_Mirroring(t *testing.T) {
+	mirror := func(id string, enabled bool, seen time.Duration) map[string]interface{} {
+		return map[string]interface{}{"id": id, "enabled": enabled, "lastSeenDate": time.Now().Add(-seen).UnixMilli()}
+	}
+	var mirrors []interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/mirroring/1.0/mirrorServers" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(page(mirrors...))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		mirrors []interface{}
+		want    string // empty when the component is skipped
+	}{
+		{"all enabled mirrors seen", []interface{}{mirror("m1", true, time.Minute), mirror("m2", false, 24*time.Hour)}, "1"},
+		{"an enabled mirror unseen", []interface{}{mirror("m1", true, time.Minute), mirror("m2", true, time.Hour)}, "0"},
+		{"no enabled mirrors", []interface{}{mirror("m1", false, time.Minute)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirrors = tt.mirrors
+			out := scrape(t, healthMetrics(ts.URL))
+			got := strings.Contains(out, `component="mirroring"`)
+			if tt.want == "" && got {
+				t.Errorf("mirroring reported without enabled mirrors\n%s", out)
+			}
+			if want := `bitbucket_component_healthy{component="mirroring"} ` + tt.want; tt.want != "" && !strings.Contains(out, want) {
+				t.Errorf("scrape missing %q\n%s", want, out)
+			}
+		})
+	}
+}
+
+func TestServerState_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+	defer func(c *http.Client) { statusClient = c }(statusClient)
+	statusClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	if _, err := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false).serverState(); err == nil {
+		t.Errorf("expected a hanging /status to time out")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverLicense is the Data Center license as returned by /admin/license.
+type serverLicense struct {
+	ExpiryDate             int64 `json:"expiryDate"`            // epoch milliseconds, 0 for perpetual licenses
+	MaintenanceExpiryDate  int64 `json:"maintenanceExpiryDate"` // epoch milliseconds
+	MaximumNumberOfUsers   int   `json:"maximumNumberOfUsers"`
+	UnlimitedNumberOfUsers bool  `json:"unlimitedNumberOfUsers"`
+	Status                 struct {
+		CurrentNumberOfUsers int `json:"currentNumberOfUsers"`
+	} `json:"status"`
+}
+
+// LicenseCollector reports the Data Center license tier usage and the server
+// version. Reading the license needs an admin account.
+type LicenseCollector struct {
+	client   *BitbucketClient
+	logLevel string
+
+	licenseUsersLimit        *prometheus.Desc
+	licenseUsersCurrent      *prometheus.Desc
+	licenseExpiry            *prometheus.Desc
+	licenseMaintenanceExpiry *prometheus.Desc
+	serverInfo               *prometheus.Desc
+}
+
+func NewLicenseCollector(client *BitbucketClient, logLevel string) *LicenseCollector {
+	return &LicenseCollector{
+		client:                   client,
+		logLevel:                 logLevel,
+		licenseUsersLimit:        prometheus.NewDesc("bitbucket_license_users_limit", "Number of users the license allows (absent for unlimited licenses)", nil, nil),
+		licenseUsersCurrent:      prometheus.NewDesc("bitbucket_license_users_current", "Number of users currently counting against the license", nil, nil),
+		licenseExpiry:            prometheus.NewDesc("bitbucket_license_expiry_timestamp", "Unix timestamp the license expires (absent for perpetual licenses)", nil, nil),
+		licenseMaintenanceExpiry: prometheus.NewDesc("bitbucket_license_maintenance_expiry_timestamp", "Unix timestamp software maintenance expires", nil, nil),
+		serverInfo:               prometheus.NewDesc("bitbucket_server_info", "Bitbucket Data Center version", []string{"version", "build_number", "display_name"}, nil),
+	}
+}
+
+func (c *LicenseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.licenseUsersLimit
+	ch <- c.licenseUsersCurrent
+	ch <- c.licenseExpiry
+	ch <- c.licenseMaintenanceExpiry
+	ch <- c.serverInfo
+}
+
+func (c *LicenseCollector) Collect(ch chan<- prometheus.Metric) {
+	// Licensing and application properties only exist on Data Center/Server.
+	if c.client.Cloud {
+		return
+	}
+	var props struct {
+		Version     string `json:"version"`
+		BuildNumber string `json:"buildNumber"`
+		DisplayName string `json:"displayName"`
+	}
+	if err := c.client.getJSON(c.client.BaseURL+"/rest/api/1.0/application-properties", &props); err != nil {
+		log.Printf("error fetching application properties: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.serverInfo, prometheus.GaugeValue, 1, props.Version, props.BuildNumber, props.DisplayName)
+	}
+
+	var license serverLicense
+	if err := c.client.getJSON(c.client.BaseURL+"/rest/api/1.0/admin/license", &license); err != nil {
+		debugf(c.logLevel, "Failed to fetch license: %v", err)
+		return
+	}
+	if !license.UnlimitedNumberOfUsers {
+		ch <- prometheus.MustNewConstMetric(c.licenseUsersLimit, prometheus.GaugeValue, float64(license.MaximumNumberOfUsers))
+	}
+	ch <- prometheus.MustNewConstMetric(c.licenseUsersCurrent, prometheus.GaugeValue, float64(license.Status.CurrentNumberOfUsers))
+	if license.ExpiryDate > 0 {
+		ch <- prometheus.MustNewConstMetric(c.licenseExpiry, prometheus.GaugeValue, float64(time.UnixMilli(license.ExpiryDate).Unix()))
+	}
+	if license.MaintenanceExpiryDate > 0 {
+		ch <- prometheus.MustNewConstMetric(c.licenseMaintenanceExpiry, prometheus.GaugeValue, float64(time.UnixMilli(license.MaintenanceExpiryDate).Unix()))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLicenseCollector(t *testing.T) {
+	var license interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/rest/api/1.0/application-properties":
+			body = map[string]string{"version": "8.19.1", "buildNumber": "8019001", "displayName": "Bitbucket"}
+		case "/rest/api/1.0/admin/license":
+			if license == nil {
+				w.WriteHeader(401)
+				return
+			}
+			body = license
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+	c := NewLicenseCollector(NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false), "info")
+	serverInfo := `bitbucket_server_info{build_number="8019001",display_name="Bitbucket",version="8.19.1"} 1`
+
+	tests := []struct {
+		name    string
+		license interface{}
+		want    []string
+		absent  []string
+	}{
+		{
+			name: "limited term license",
+			license: map[string]interface{}{
+				"expiryDate": int64(1735689600000), "maintenanceExpiryDate": int64(1735689600000),
+				"maximumNumberOfUsers": 500, "status": map[string]int{"currentNumberOfUsers": 420},
+			},
+			want: []string{
+				serverInfo,
+				`bitbucket_license_users_limit 500`,
+				`bitbucket_license_users_current 420`,
+				`bitbucket_license_expiry_timestamp 1.7356896e+09`,
+				`bitbucket_license_maintenance_expiry_timestamp 1.7356896e+09`,
+			},
+		},
+		{
+			name: "unlimited license",
+			license: map[string]interface{}{
+				"expiryDate": int64(1735689600000), "maintenanceExpiryDate": int64(1735689600000),
+				"unlimitedNumberOfUsers": true, "status": map[string]int{"currentNumberOfUsers": 1200},
+			},
+			want:   []string{serverInfo, `bitbucket_license_users_current 1200`},
+			absent: []string{"bitbucket_license_users_limit"},
+		},
+		{
+			name: "perpetual license",
+			license: map[string]interface{}{
+				"maintenanceExpiryDate": int64(1735689600000),
+				"maximumNumberOfUsers":  50, "status": map[string]int{"currentNumberOfUsers": 12},
+			},
+			want:   []string{serverInfo, `bitbucket_license_users_limit 50`, `bitbucket_license_maintenance_expiry_timestamp 1.7356896e+09`},
+			absent: []string{"bitbucket_license_expiry_timestamp"},
+		},
+		{
+			// Without an admin account only the server version is reported.
+			name:   "license not readable",
+			want:   []string{serverInfo},
+			absent: []string{"bitbucket_license_"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			license = tt.license
+			out := scrape(t, c)
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("scrape missing %q\n%s", want, out)
+				}
+			}
+			for _, unwanted := range tt.absent {
+				if strings.Contains(out, unwanted) {
+					t.Errorf("scrape has %q\n%s", unwanted, out)
+				}
+			}
+		})
+	}
+}
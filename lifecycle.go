@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inventoryKey identifies a repository across renames and moves, falling back
+// to its path when the listing carries no id.
+func inventoryKey(repo Repository) string {
+	if repo.UUID != "" {
+		return repo.UUID
+	}
+	return repo.ProjectKey + "/" + repo.Slug
+}
+
+// repoChanges is the difference between two repository inventories.
+type repoChanges struct {
+	created  []Repository
+	deleted  []Repository
+	renamed  [][2]Repository // old, new
+	archived []Repository
+}
+
+// diffInventories compares the previous inventory, keyed by inventoryKey, with
+// the current listing. A repository keeping its id under a different project
+// or slug is renamed rather than deleted and created.
+func diffInventories(prev map[string]Repository, repos []Repository) repoChanges {
+	var changes repoChanges
+	seen := make(map[string]bool, len(repos))
+	for _, repo := range repos {
+		key := inventoryKey(repo)
+		seen[key] = true
+		old, ok := prev[key]
+		if !ok {
+			changes.created = append(changes.created, repo)
+			continue
+		}
+		if old.ProjectKey != repo.ProjectKey || old.Slug != repo.Slug {
+			changes.renamed = append(changes.renamed, [2]Repository{old, repo})
+		}
+		if repo.Archived && !old.Archived {
+			changes.archived = append(changes.archived, repo)
+		}
+	}
+	for key, old := range prev {
+		if !seen[key] {
+			changes.deleted = append(changes.deleted, old)
+		}
+	}
+	return changes
+}
+
+// LifecycleCollector diffs consecutive repository inventories and counts
+// repositories created, deleted, renamed or moved, and archived, per project.
+// Each change is also logged as a key=value event. The first inventory is the
+// baseline and counts nothing; it is persisted to inventoryFile, if set, so
+// changes made while the exporter was down are counted on restart.
+type LifecycleCollector struct {
+	client        *BitbucketClient
+	logLevel      string
+	inventoryFile string
+
+	mu        sync.Mutex
+	inventory map[string]Repository // nil until the baseline is taken
+
+	createdTotal  *prometheus.CounterVec
+	deletedTotal  *prometheus.CounterVec
+	renamedTotal  *prometheus.CounterVec
+	archivedTotal *prometheus.CounterVec
+}
+
+func NewLifecycleCollector(client *BitbucketClient, inventoryFile string, logLevel string) *LifecycleCollector {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, []string{"project_key"})
+	}
+	c := &LifecycleCollector{
+		client:        client,
+		logLevel:      logLevel,
+		inventoryFile: inventoryFile,
+		createdTotal:  counter("bitbucket_repositories_created_total", "Repositories that appeared in the inventory, per project"),
+		deletedTotal:  counter("bitbucket_repositories_deleted_total", "Repositories that disappeared from the inventory, per project they were in"),
+		renamedTotal:  counter("bitbucket_repositories_renamed_total", "Repositories renamed or moved, detected by UUID, per project they are now in"),
+		archivedTotal: counter("bitbucket_repositories_archived_total", "Repositories that were archived, per project (Data Center only)"),
+	}
+	c.inventory = c.loadInventory()
+	return c
+}
+
+func (c *LifecycleCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.createdTotal.Describe(ch)
+	c.deletedTotal.Describe(ch)
+	c.renamedTotal.Describe(ch)
+	c.archivedTotal.Describe(ch)
+}
+
+func (c *LifecycleCollector) Collect(ch chan<- prometheus.Metric) {
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		// A failed listing must not look like every repository was deleted.
+		log.Printf("error listing repositories for lifecycle events: %v", err)
+	} else {
+		c.mu.Lock()
+		c.observe(repos)
+		c.mu.Unlock()
+	}
+	c.createdTotal.Collect(ch)
+	c.deletedTotal.Collect(ch)
+	c.renamedTotal.Collect(ch)
+	c.archivedTotal.Collect(ch)
+}
+
+// observe counts and logs the changes since the previous inventory and makes
+// repos the new one.
+func (c *LifecycleCollector) observe(repos []Repository) {
+	current := make(map[string]Repository, len(repos))
+	for _, repo := range repos {
+		current[inventoryKey(repo)] = repo
+	}
+	if c.inventory == nil {
+		debugf(c.logLevel, "Repository inventory baseline taken with %d repositories", len(repos))
+		c.inventory = current
+		c.saveInventory()
+		return
+	}
+	changes := diffInventories(c.inventory, repos)
+	for _, r := range changes.created {
+		c.createdTotal.WithLabelValues(r.ProjectKey).Inc()
+		log.Printf("repo_event=created project_key=%s repo_slug=%s uuid=%s", r.ProjectKey, r.Slug, r.UUID)
+	}
+	for _, r := range changes.deleted {
+		c.deletedTotal.WithLabelValues(r.ProjectKey).Inc()
+		log.Printf("repo_event=deleted project_key=%s repo_slug=%s uuid=%s", r.ProjectKey, r.Slug, r.UUID)
+	}
+	for _, r := range changes.renamed {
+		c.renamedTotal.WithLabelValues(r[1].ProjectKey).Inc()
+		log.Printf("repo_event=renamed project_key=%s repo_slug=%s old_project_key=%s old_repo_slug=%s uuid=%s", r[1].ProjectKey, r[1].Slug, r[0].ProjectKey, r[0].Slug, r[1].UUID)
+	}
+	for _, r := range changes.archived {
+		c.archivedTotal.WithLabelValues(r.ProjectKey).Inc()
+		log.Printf("repo_event=archived project_key=%s repo_slug=%s uuid=%s", r.ProjectKey, r.Slug, r.UUID)
+	}
+	c.inventory = current
+	if len(changes.created)+len(changes.deleted)+len(changes.renamed)+len(changes.archived) > 0 {
+		c.saveInventory()
+	}
+}
+
+// loadInventory reads the persisted inventory, nil when there is none.
+func (c *LifecycleCollector) loadInventory() map[string]Repository {
+	if c.inventoryFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.inventoryFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var inventory map[string]Repository
+	if err == nil {
+		err = json.Unmarshal(data, &inventory)
+	}
+	if err != nil {
+		log.Printf("error reading repository inventory %s, taking a new baseline: %v", c.inventoryFile, err)
+		return nil
+	}
+	return inventory
+}
+
+// saveInventory persists the inventory, replacing the file atomically.
+func (c *LifecycleCollector) saveInventory() {
+	if c.inventoryFile == "" {
+		return
+	}
+	data, _ := json.Marshal(c.inventory)
+	tmp := c.inventoryFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("error writing repository inventory: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.inventoryFile); err != nil {
+		log.Printf("error writing repository inventory: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLifecycleCollector_DiffsInventories(t *testing.T) {
+	repo := func(id int, project, slug string, archived bool) interface{} {
+		return map[string]interface{}{"id": id, "slug": slug, "name": slug, "archived": archived, "project": map[string]string{"key": project}}
+	}
+	inventory := []interface{}{repo(1, "PRJ", "app", false), repo(2, "PRJ", "lib", false), repo(3, "OPS", "infra", false)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(page(inventory...))
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+	inventoryFile := filepath.Join(t.TempDir(), "inventory.json")
+
+	c := NewLifecycleCollector(client, inventoryFile, "info")
+	if out := scrape(t, c); strings.Contains(out, "bitbucket_repositories_created_total{") {
+		t.Errorf("baseline inventory was counted as created\n%s", out)
+	}
+
+	// lib is moved to OPS and renamed, infra deleted, app archived, web created.
+	inventory = []interface{}{repo(1, "PRJ", "app", true), repo(2, "OPS", "lib-core", false), repo(4, "PRJ", "web", false)}
+	client.repoCache = nil
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_repositories_created_total{project_key="PRJ"} 1`,
+		`bitbucket_repositories_deleted_total{project_key="OPS"} 1`,
+		`bitbucket_repositories_renamed_total{project_key="OPS"} 1`,
+		`bitbucket_repositories_archived_total{project_key="PRJ"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+
+	// A restart picks up the persisted inventory instead of taking a new baseline.
+	inventory = inventory[:2]
+	client.repoCache = nil
+	restarted := NewLifecycleCollector(client, inventoryFile, "info")
+	if out := scrape(t, restarted); !strings.Contains(out, `bitbucket_repositories_deleted_total{project_key="PRJ"} 1`) {
+		t.Errorf("deletion while down was not counted\n%s", out)
+	}
+}
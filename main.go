@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -13,6 +14,8 @@ func main() {
 	port := flag.String("port", "8080", "Port to listen on")
 	logLevel := flag.String("log.level", "info", "Log level: debug, info, warn, error")
 	cloud := flag.Bool("cloud", false, "Set to true for Bitbucket Cloud, false for Data Center/Server")
+	refreshInterval := flag.Duration("refresh.interval", 0, "Minimum age of cached per-repo metrics before a scrape refetches all repos (0 refetches on every scrape)")
+	webhookDebounce := flag.Duration("webhook.debounce", 10*time.Second, "Window in which webhook events for the same repo are coalesced into one refresh")
 	flag.Parse()
 
 	log.Printf("Starting Bitbucket exporter on :%s/metrics (log level: %s, cloud: %v)", *port, *logLevel, *cloud)
@@ -27,9 +30,29 @@ func main() {
 	client := NewBitbucketClient(cfg, *cloud)
 
 	// Register Prometheus collector
-	collector := NewBitbucketCollector(client, *logLevel)
+	collector := NewBitbucketCollector(client, cfg, *logLevel, *refreshInterval)
 	prometheus.MustRegister(collector)
+	prometheus.MustRegister(NewPipelineCollector(client, *logLevel))
+	prometheus.MustRegister(NewRunnerCollector(client, *logLevel))
+	prometheus.MustRegister(NewDeploymentCollector(client, *logLevel))
+	prometheus.MustRegister(NewWebhookInventoryCollector(client, *logLevel))
+	prometheus.MustRegister(NewPermissionCollector(client, *logLevel))
+	prometheus.MustRegister(NewLicenseCollector(client, *logLevel))
+	prometheus.MustRegister(NewMirrorCollector(client, cfg.MirrorProbeHosts, *logLevel))
+	prometheus.MustRegister(NewVariableCollector(client, cfg.SecretVariablePatterns, *logLevel))
+	prometheus.MustRegister(NewAuditCollector(client, cfg.AuditCursorFile, cfg.AuditActions, *logLevel))
+	prometheus.MustRegister(NewLifecycleCollector(client, cfg.RepoInventoryFile, *logLevel))
+	prometheus.MustRegister(NewMemberCollector(client, collector.activity, cfg.DormantDays, *logLevel))
+
+	// Webhook receiver for event-driven counters
+	refresher := newRepoRefresher(collector.RefreshRepo, *webhookDebounce)
+	webhooks := NewWebhookReceiver(cfg.WebhookSecret, *logLevel, refresher.Trigger)
+	if cfg.WebhookSecret == "" {
+		log.Println("[WARN] BITBUCKET_WEBHOOK_SECRET is not set; webhook deliveries are accepted unsigned")
+	}
+	prometheus.MustRegister(webhooks)
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/webhook", webhooks)
 	log.Fatal(http.ListenAndServe(":"+*port, nil))
 }
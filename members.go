@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// activityTracker remembers when each account last authored a commit or pull
+// request, as seen by the per-repo refresh cycle. Commits whose author is not
+// linked to an account are recorded under authorNameKey of the author name.
+type activityTracker struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time // account id or author name key -> latest authored commit or PR
+	primed   bool                 // a full refresh cycle has completed
+}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{lastSeen: make(map[string]time.Time)}
+}
+
+// authorNameKey is the activity key of a commit author name, empty for no name.
+func authorNameKey(name string) string {
+	if name = strings.TrimSpace(name); name == "" {
+		return ""
+	}
+	return "name:" + strings.ToLower(name)
+}
+
+// rawAuthorName returns the name part of a raw "Name <email>" commit author.
+func rawAuthorName(raw string) string {
+	if i := strings.Index(raw, "<"); i >= 0 {
+		raw = raw[:i]
+	}
+	return strings.TrimSpace(raw)
+}
+
+// observe records activity under key, an account id or author name key, at t.
+func (a *activityTracker) observe(key string, t time.Time) {
+	if key == "" || t.IsZero() {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t.After(a.lastSeen[key]) {
+		a.lastSeen[key] = t
+	}
+}
+
+// markPrimed is called after a full refresh cycle has walked every repository.
+func (a *activityTracker) markPrimed() {
+	a.mu.Lock()
+	a.primed = true
+	a.mu.Unlock()
+}
+
+// isPrimed reports whether dormancy can be judged yet, i.e. a full refresh
+// cycle has completed.
+func (a *activityTracker) isPrimed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.primed
+}
+
+// last returns the latest activity recorded under any of keys.
+func (a *activityTracker) last(keys ...string) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var latest time.Time
+	for _, k := range keys {
+		if t := a.lastSeen[k]; t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// workspaceMember is a Cloud workspace member.
+type workspaceMember struct {
+	AccountID     string
+	Nickname      string
+	DisplayName   string
+	AccountStatus string
+	TwoFactor     string // enabled, disabled or unknown when the API does not expose it
+}
+
+// WorkspaceMembers lists every member of the Cloud workspace.
+func (c *BitbucketClient) WorkspaceMembers() ([]workspaceMember, error) {
+	values, err := cloudPages[struct {
+		User struct {
+			AccountID     string `json:"account_id"`
+			Nickname      string `json:"nickname"`
+			DisplayName   string `json:"display_name"`
+			AccountStatus string `json:"account_status"`
+			HasTwoFactor  *bool  `json:"has_2fa_enabled"`
+		} `json:"user"`
+	}](c, cloudAPIURL+"/workspaces/"+c.Workspace+"/members?pagelen=100")
+	if err != nil {
+		return nil, err
+	}
+	members := make([]workspaceMember, 0, len(values))
+	for _, v := range values {
+		m := workspaceMember{v.User.AccountID, v.User.Nickname, v.User.DisplayName, v.User.AccountStatus, "unknown"}
+		if m.Nickname == "" {
+			m.Nickname = v.User.DisplayName
+		}
+		if m.AccountStatus == "" {
+			m.AccountStatus = "unknown"
+		}
+		if v.User.HasTwoFactor != nil {
+			m.TwoFactor = "disabled"
+			if *v.User.HasTwoFactor {
+				m.TwoFactor = "enabled"
+			}
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// PullRequestsCreatedSince returns the pull requests of a Cloud repository
+// created at or after since, in any state.
+func (c *BitbucketClient) PullRequestsCreatedSince(repo Repository, since time.Time) ([]PullRequest, error) {
+	q := url.QueryEscape("created_on>=" + since.UTC().Format(time.RFC3339))
+	values, err := cloudPages[struct {
+		ID     int `json:"id"`
+		Author struct {
+			AccountID string `json:"account_id"`
+		} `json:"author"`
+		CreatedOn string `json:"created_on"`
+	}](c, c.repoPath(repo)+"/pullrequests?state=OPEN&state=MERGED&state=DECLINED&state=SUPERSEDED&pagelen=50&q="+q)
+	if err != nil {
+		return nil, err
+	}
+	prs := make([]PullRequest, 0, len(values))
+	for _, v := range values {
+		created, _ := time.Parse(time.RFC3339, v.CreatedOn)
+		prs = append(prs, PullRequest{ID: v.ID, AuthorID: v.Author.AccountID, CreatedOn: created})
+	}
+	return prs, nil
+}
+
+// MemberCollector reports workspace members by 2FA and account status, and
+// flags members who have not authored a commit or pull request recently.
+type MemberCollector struct {
+	client      *BitbucketClient
+	logLevel    string
+	activity    *activityTracker
+	dormantDays int
+
+	membersTotal        *prometheus.Desc
+	dormantMembersTotal *prometheus.Desc
+	memberDormant       *prometheus.Desc
+}
+
+func NewMemberCollector(client *BitbucketClient, activity *activityTracker, dormantDays int, logLevel string) *MemberCollector {
+	return &MemberCollector{
+		client:              client,
+		logLevel:            logLevel,
+		activity:            activity,
+		dormantDays:         dormantDays,
+		membersTotal:        prometheus.NewDesc("bitbucket_workspace_members_total", "Number of workspace members by 2FA and account status", []string{"two_factor", "account_status"}, nil),
+		dormantMembersTotal: prometheus.NewDesc("bitbucket_workspace_dormant_members_total", "Number of workspace members without an authored commit or PR within the dormancy window", nil, nil),
+		memberDormant:       prometheus.NewDesc("bitbucket_workspace_member_dormant", "Workspace member without an authored commit or PR within the dormancy window", []string{"account_id", "user"}, nil),
+	}
+}
+
+func (c *MemberCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.membersTotal
+	ch <- c.dormantMembersTotal
+	ch <- c.memberDormant
+}
+
+func (c *MemberCollector) Collect(ch chan<- prometheus.Metric) {
+	// Workspace membership is a Bitbucket Cloud concept.
+	if !c.client.Cloud {
+		return
+	}
+	members, err := c.client.WorkspaceMembers()
+	if err != nil {
+		log.Printf("error fetching workspace members: %v", err)
+		return
+	}
+	counts := make(map[[2]string]int)
+	for _, m := range members {
+		counts[[2]string{m.TwoFactor, m.AccountStatus}]++
+	}
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.membersTotal, prometheus.GaugeValue, float64(n), k[0], k[1])
+	}
+
+	if !c.activity.isPrimed() {
+		debugf(c.logLevel, "Skipping dormant members until the first full refresh has completed")
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -c.dormantDays)
+	dormant := 0
+	for _, m := range members {
+		// Commits not linked to an account can only be matched by author name.
+		last := c.activity.last(m.AccountID, authorNameKey(m.DisplayName), authorNameKey(m.Nickname))
+		if last.Before(cutoff) {
+			dormant++
+			ch <- prometheus.MustNewConstMetric(c.memberDormant, prometheus.GaugeValue, 1, m.AccountID, m.Nickname)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.dormantMembersTotal, prometheus.GaugeValue, float64(dormant))
+}
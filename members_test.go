@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemberCollector_TwoFactorAndDormant(t *testing.T) {
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+			map[string]interface{}{"user": map[string]interface{}{"account_id": "a1", "nickname": "alice", "account_status": "active", "has_2fa_enabled": true}},
+			map[string]interface{}{"user": map[string]interface{}{"account_id": "b2", "nickname": "bob", "account_status": "active"}},
+			map[string]interface{}{"user": map[string]interface{}{"account_id": "c3", "nickname": "ck", "display_name": "Carol King", "account_status": "active"}},
+			// Nicknames are not unique across accounts.
+			map[string]interface{}{"user": map[string]interface{}{"account_id": "b3", "nickname": "bob", "account_status": "active"}},
+		}})
+	}))
+	activity := newActivityTracker()
+	c := NewMemberCollector(client, activity, 30, "info")
+
+	if out := scrape(t, c); strings.Contains(out, "dormant") {
+		t.Errorf("dormancy reported before the first full refresh:\n%s", out)
+	}
+
+	activity.observe("a1", time.Now().AddDate(0, 0, -1))
+	activity.observe("b2", time.Now().AddDate(0, 0, -60))
+	// Carol commits from an email not linked to her account.
+	activity.observe(authorNameKey(rawAuthorName("Carol King <carol@home.example>")), time.Now().AddDate(0, 0, -2))
+	activity.markPrimed()
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_workspace_members_total{account_status="active",two_factor="enabled"} 1`,
+		`bitbucket_workspace_members_total{account_status="active",two_factor="unknown"} 3`,
+		`bitbucket_workspace_dormant_members_total 2`,
+		`bitbucket_workspace_member_dormant{account_id="b2",user="bob"} 1`,
+		`bitbucket_workspace_member_dormant{account_id="b3",user="bob"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q", want)
+		}
+	}
+}
+
+func TestRefreshRepo_RecordsActivity(t *testing.T) {
+	recent := time.Now().AddDate(0, 0, -3).UTC().Format(time.RFC3339)
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/2.0/repositories/testws":
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"slug": "app", "name": "App", "project": map[string]interface{}{"key": "PRJ"}},
+			}}
+		case "/2.0/repositories/testws/app/commits":
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"date": recent, "author": map[string]interface{}{"raw": "Alice <alice@example.com>", "user": map[string]string{"account_id": "a1"}}},
+				map[string]interface{}{"date": recent, "author": map[string]interface{}{"raw": "Carol King <carol@home.example>"}},
+			}}
+		case "/2.0/repositories/testws/app/pullrequests":
+			if states := r.URL.Query()["state"]; len(states) != 4 || r.URL.Query().Get("q") == "" {
+				body = map[string]interface{}{"values": []interface{}{}}
+				break
+			}
+			// Merged pull requests count as activity too.
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"id": 1, "state": "MERGED", "author": map[string]string{"account_id": "b2"}, "created_on": recent},
+			}}
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	c := NewBitbucketCollector(client, &Config{DormantDays: 30}, "info", 0)
+	if err := c.RefreshRepo("PRJ", "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a1", "b2", authorNameKey("carol king")} {
+		if c.activity.last(key).IsZero() {
+			t.Errorf("no activity recorded for %s", key)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mirrorOfflineAfter is how long a mirror may go unseen by the upstream before it counts as offline.
+const mirrorOfflineAfter = 5 * time.Minute
+
+// mirrorServer is a smart mirror registered with the upstream Data Center instance.
+type mirrorServer struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	BaseURL        string `json:"baseUrl"`
+	Enabled        bool   `json:"enabled"`
+	LastSeenDate   int64  `json:"lastSeenDate"` // epoch milliseconds
+	MirrorType     string `json:"mirrorType"`
+	ProductVersion string `json:"productVersion"`
+}
+
+// up reports whether the mirror is enabled and was seen by the upstream within mirrorOfflineAfter of now.
+func (m mirrorServer) up(now time.Time) bool {
+	return m.Enabled && m.LastSeenDate > 0 && now.Sub(time.UnixMilli(m.LastSeenDate)) < mirrorOfflineAfter
+}
+
+// mirrorsHealthy reports whether every enabled mirror is up. ok is false when
+// no mirror is enabled, so there is no mirroring to judge.
+func mirrorsHealthy(mirrors []mirrorServer, now time.Time) (healthy, ok bool) {
+	healthy = true
+	for _, m := range mirrors {
+		if !m.Enabled {
+			continue
+		}
+		ok = true
+		healthy = healthy && m.up(now)
+	}
+	return healthy, ok
+}
+
+// MirrorCollector reports the smart mirrors of a Data Center instance from the
+// upstream mirroring API and, for mirrors on probeHosts, from each mirror's
+// own endpoints. Probing sends the exporter's credentials to the mirror, so
+// only hosts listed explicitly are probed, never every registered baseUrl.
+type MirrorCollector struct {
+	client     *BitbucketClient
+	logLevel   string
+	probeHosts []string // host or host:port, matched case-insensitively
+
+	mirrorInfo        *prometheus.Desc
+	mirrorUp          *prometheus.Desc
+	mirrorLastSeen    *prometheus.Desc
+	mirrorLastSync    *prometheus.Desc
+	mirrorRepos       *prometheus.Desc
+	mirrorReposBehind *prometheus.Desc
+}
+
+func NewMirrorCollector(client *BitbucketClient, probeHosts []string, logLevel string) *MirrorCollector {
+	return &MirrorCollector{
+		client:            client,
+		logLevel:          logLevel,
+		probeHosts:        probeHosts,
+		mirrorInfo:        prometheus.NewDesc("bitbucket_mirror_info", "Smart mirror registered with the upstream", []string{"mirror_id", "name", "base_url", "mirror_type", "version"}, nil),
+		mirrorUp:          prometheus.NewDesc("bitbucket_mirror_up", "Whether the mirror is enabled and was seen by the upstream recently (0/1)", []string{"mirror_id", "name"}, nil),
+		mirrorLastSeen:    prometheus.NewDesc("bitbucket_mirror_last_seen_timestamp", "Unix timestamp the upstream last heard from the mirror", []string{"mirror_id", "name"}, nil),
+		mirrorLastSync:    prometheus.NewDesc("bitbucket_mirror_last_sync_timestamp", "Unix timestamp of the most recent repository synchronization on the mirror", []string{"mirror_id", "name"}, nil),
+		mirrorRepos:       prometheus.NewDesc("bitbucket_mirror_repos_total", "Number of repositories mirrored", []string{"mirror_id", "name"}, nil),
+		mirrorReposBehind: prometheus.NewDesc("bitbucket_mirror_repos_out_of_sync", "Number of mirrored repositories not in sync with the upstream", []string{"mirror_id", "name"}, nil),
+	}
+}
+
+func (c *MirrorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.mirrorInfo
+	ch <- c.mirrorUp
+	ch <- c.mirrorLastSeen
+	ch <- c.mirrorLastSync
+	ch <- c.mirrorRepos
+	ch <- c.mirrorReposBehind
+}
+
+func (c *MirrorCollector) Collect(ch chan<- prometheus.Metric) {
+	// Smart mirrors are a Data Center feature.
+	if c.client.Cloud {
+		return
+	}
+	mirrors, err := serverPages[mirrorServer](c.client, c.client.BaseURL+"/rest/mirroring/1.0/mirrorServers?limit=100")
+	if err == statusError(http.StatusNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("error listing mirror servers: %v", err)
+		return
+	}
+	var repoCounts map[string]int
+	if len(mirrors) > 0 {
+		if repoCounts, err = c.upstreamRepoCounts(); err != nil {
+			debugf(c.logLevel, "Failed to count mirrored repositories on the upstream: %v", err)
+		}
+	}
+	for _, m := range mirrors {
+		ch <- prometheus.MustNewConstMetric(c.mirrorInfo, prometheus.GaugeValue, 1, m.ID, m.Name, m.BaseURL, m.MirrorType, m.ProductVersion)
+		if m.LastSeenDate > 0 {
+			ch <- prometheus.MustNewConstMetric(c.mirrorLastSeen, prometheus.GaugeValue, float64(time.UnixMilli(m.LastSeenDate).Unix()), m.ID, m.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(c.mirrorUp, prometheus.GaugeValue, boolToFloat(m.up(time.Now())), m.ID, m.Name)
+		if repoCounts != nil {
+			ch <- prometheus.MustNewConstMetric(c.mirrorRepos, prometheus.GaugeValue, float64(repoCounts[m.ID]), m.ID, m.Name)
+		}
+		if c.probeAllowed(m) {
+			// The mirror's own count is only used when the upstream could not provide one.
+			c.probeMirror(ch, m, repoCounts == nil)
+		}
+	}
+}
+
+// upstreamRepoCounts counts, per mirror id, the repositories the upstream
+// lists as mirrored. The upstream has no sync state, so the out-of-sync
+// count is only known from probing the mirror.
+func (c *MirrorCollector) upstreamRepoCounts() (map[string]int, error) {
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, repo := range repos {
+		mirrors, err := serverPages[struct {
+			MirrorServer struct {
+				ID string `json:"id"`
+			} `json:"mirrorServer"`
+		}](c.client, c.client.BaseURL+"/rest/mirroring/1.0/repos/"+url.PathEscape(repo.UUID)+"/mirrors?limit=100")
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", repo.ProjectKey, repo.Slug, err)
+		}
+		for _, m := range mirrors {
+			counts[m.MirrorServer.ID]++
+		}
+	}
+	return counts, nil
+}
+
+// probeAllowed reports whether the mirror's base URL is on one of the probe hosts.
+func (c *MirrorCollector) probeAllowed(m mirrorServer) bool {
+	if m.BaseURL == "" || len(c.probeHosts) == 0 {
+		return false
+	}
+	u, err := url.Parse(m.BaseURL)
+	if err != nil {
+		return false
+	}
+	for _, h := range c.probeHosts {
+		if strings.EqualFold(h, u.Host) || (u.Port() == "" && strings.EqualFold(h, u.Hostname())) {
+			return true
+		}
+	}
+	debugf(c.logLevel, "Not probing mirror %s: %s is not a probe host", m.Name, u.Host)
+	return false
+}
+
+// probeMirror asks the mirror itself which repositories it mirrors from this
+// upstream and how far their synchronization has got. The repository count is
+// reported only if withRepoCount is set.
+func (c *MirrorCollector) probeMirror(ch chan<- prometheus.Metric, m mirrorServer, withRepoCount bool) {
+	base := strings.TrimSuffix(m.BaseURL, "/") + "/rest/mirroring/latest/upstreamServers"
+	upstreams, err := serverPages[struct {
+		ID      string `json:"id"`
+		BaseURL string `json:"baseUrl"`
+	}](c.client, base+"?limit=100")
+	if err != nil {
+		debugf(c.logLevel, "Failed to probe mirror %s: %v", m.Name, err)
+		return
+	}
+	for _, u := range upstreams {
+		if strings.TrimSuffix(u.BaseURL, "/") != strings.TrimSuffix(c.client.BaseURL, "/") {
+			continue
+		}
+		repos, err := serverPages[struct {
+			Status      string `json:"status"`
+			LastUpdated int64  `json:"lastUpdated"` // epoch milliseconds
+		}](c.client, base+"/"+u.ID+"/repos?limit=1000")
+		if err != nil {
+			debugf(c.logLevel, "Failed to list repos on mirror %s: %v", m.Name, err)
+			return
+		}
+		behind := 0
+		var lastSync int64
+		for _, r := range repos {
+			if r.Status != "AVAILABLE" {
+				behind++
+			}
+			if r.LastUpdated > lastSync {
+				lastSync = r.LastUpdated
+			}
+		}
+		if withRepoCount {
+			ch <- prometheus.MustNewConstMetric(c.mirrorRepos, prometheus.GaugeValue, float64(len(repos)), m.ID, m.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(c.mirrorReposBehind, prometheus.GaugeValue, float64(behind), m.ID, m.Name)
+		if lastSync > 0 {
+			ch <- prometheus.MustNewConstMetric(c.mirrorLastSync, prometheus.GaugeValue, float64(time.UnixMilli(lastSync).Unix()), m.ID, m.Name)
+		}
+		return
+	}
+	debugf(c.logLevel, "Mirror %s does not list %s as an upstream", m.Name, c.client.BaseURL)
+}
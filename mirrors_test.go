@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mirrorUpstream serves the upstream mirroring API, with mirror m1 at
+// mirrorURL and m2 at otherURL. Without upstreamCounts the per-repository
+// mirror listing is missing, as on servers that do not expose it.
+func mirrorUpstream(t *testing.T, mirrorURL, otherURL string, upstreamCounts bool) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirror := func(id string) map[string]interface{} {
+			return map[string]interface{}{"mirrorServer": map[string]string{"id": id}}
+		}
+		var body interface{}
+		switch {
+		case r.URL.Path == "/rest/mirroring/1.0/mirrorServers":
+			body = page(
+				map[string]interface{}{"id": "m1", "name": "apac", "baseUrl": mirrorURL, "enabled": true, "lastSeenDate": time.Now().UnixMilli()},
+				map[string]interface{}{"id": "m2", "name": "emea", "baseUrl": otherURL, "enabled": true, "lastSeenDate": time.Now().Add(-time.Hour).UnixMilli()},
+			)
+		case r.URL.Path == "/rest/api/1.0/repos":
+			body = page(map[string]interface{}{"id": 1, "slug": "app", "project": map[string]string{"key": "PRJ"}}, map[string]interface{}{"id": 2, "slug": "lib", "project": map[string]string{"key": "PRJ"}})
+		case upstreamCounts && r.URL.Path == "/rest/mirroring/1.0/repos/1/mirrors":
+			body = page(mirror("m1"), mirror("m2"))
+		case upstreamCounts && r.URL.Path == "/rest/mirroring/1.0/repos/2/mirrors":
+			body = page(mirror("m1"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// mirrorServerStub serves a mirror's own API, listing upstream as its upstream.
+func mirrorServerStub(t *testing.T, upstream *string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/rest/mirroring/latest/upstreamServers":
+			body = page(map[string]string{"id": "up", "baseUrl": *upstream})
+		case "/rest/mirroring/latest/upstreamServers/up/repos":
+			body = page(map[string]interface{}{"status": "AVAILABLE", "lastUpdated": 1700000000000}, map[string]interface{}{"status": "INITIALIZING"}, map[string]interface{}{"status": "AVAILABLE"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestMirrorCollector_UpstreamCountsAndProbe(t *testing.T) {
+	var upstreamURL string
+	probed := mirrorServerStub(t, &upstreamURL)
+	// m2 is not on the probe hosts and must never receive the credentials.
+	unlisted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unlisted mirror was probed: %s", r.URL.Path)
+	}))
+	defer unlisted.Close()
+	ts := mirrorUpstream(t, probed.URL, unlisted.URL, true)
+	upstreamURL = ts.URL
+	probedHost, _ := url.Parse(probed.URL)
+
+	out := scrape(t, NewMirrorCollector(NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false), []string{probedHost.Host}, "info"))
+	for _, want := range []string{
+		`bitbucket_mirror_up{mirror_id="m1",name="apac"} 1`,
+		`bitbucket_mirror_up{mirror_id="m2",name="emea"} 0`,
+		`bitbucket_mirror_repos_total{mirror_id="m1",name="apac"} 2`,
+		`bitbucket_mirror_repos_total{mirror_id="m2",name="emea"} 1`,
+		`bitbucket_mirror_repos_out_of_sync{mirror_id="m1",name="apac"} 1`,
+		`bitbucket_mirror_last_sync_timestamp{mirror_id="m1",name="apac"} 1.7e+09`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `bitbucket_mirror_repos_out_of_sync{mirror_id="m2"`) {
+		t.Errorf("out-of-sync reported for an unprobed mirror\n%s", out)
+	}
+}
+
+func TestMirrorCollector_ProbeCountFallback(t *testing.T) {
+	var upstreamURL string
+	probed := mirrorServerStub(t, &upstreamURL)
+	ts := mirrorUpstream(t, probed.URL, "", false)
+	upstreamURL = ts.URL
+	probedHost, _ := url.Parse(probed.URL)
+
+	out := scrape(t, NewMirrorCollector(NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false), []string{probedHost.Host}, "info"))
+	if want := `bitbucket_mirror_repos_total{mirror_id="m1",name="apac"} 3`; !strings.Contains(out, want) {
+		t.Errorf("scrape missing %q\n%s", want, out)
+	}
+	if strings.Contains(out, `bitbucket_mirror_repos_total{mirror_id="m2"`) {
+		t.Errorf("repo count reported for a mirror with no source\n%s", out)
+	}
+}
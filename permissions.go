@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// permissionLevels are the normalised permission levels, lowest first.
+var permissionLevels = []string{"read", "write", "admin"}
+
+// permissionRank orders a normalised permission level; unknown levels rank lowest.
+func permissionRank(level string) int {
+	for i, l := range permissionLevels {
+		if l == level {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// normalisePermission maps Cloud (read, write, admin) and Data Center
+// (PROJECT_READ, REPO_ADMIN, ...) permissions onto read, write and admin.
+func normalisePermission(p string) string {
+	p = strings.ToLower(p)
+	if i := strings.LastIndex(p, "_"); i >= 0 {
+		p = p[i+1:]
+	}
+	return p
+}
+
+// grantHighest records level for user in grants unless a higher level is already there.
+func grantHighest(grants map[string]string, user, level string) {
+	if permissionRank(level) > permissionRank(grants[user]) {
+		grants[user] = level
+	}
+}
+
+// repoAccess is who can access one repository.
+type repoAccess struct {
+	repo      Repository
+	effective map[string]string // user -> highest permission, direct or through a group or project
+	direct    map[string]string // users granted on the repository itself
+}
+
+// principalGrants are the users and groups granted a permission on a project or repository.
+type principalGrants struct {
+	users  map[string]string
+	groups map[string]string
+}
+
+// PermissionCollector reports who can access which repositories, to support
+// access reviews: effective access per user, repository admins, and grants
+// made to individuals rather than groups.
+type PermissionCollector struct {
+	client   *BitbucketClient
+	logLevel string
+
+	perUserAccessRepos *prometheus.Desc
+	perUserDirectRepos *prometheus.Desc
+	repoAdminsTotal    *prometheus.Desc
+	repoDirectGrants   *prometheus.Desc
+	teamMembersTotal   *prometheus.Desc
+}
+
+func NewPermissionCollector(client *BitbucketClient, logLevel string) *PermissionCollector {
+	return &PermissionCollector{
+		client:             client,
+		logLevel:           logLevel,
+		perUserAccessRepos: prometheus.NewDesc("bitbucket_user_access_repos_total", "Number of repositories accessed per user", []string{"user", "permission_level"}, nil),
+		perUserDirectRepos: prometheus.NewDesc("bitbucket_user_direct_access_repos_total", "Number of repositories granted to the user directly rather than through a group", []string{"user", "permission_level"}, nil),
+		repoAdminsTotal:    prometheus.NewDesc("bitbucket_repo_admins_total", "Number of users with admin permission on repo", []string{"project_key", "repo_slug"}, nil),
+		repoDirectGrants:   prometheus.NewDesc("bitbucket_repo_direct_user_grants_total", "Number of users granted access to repo directly rather than through a group", []string{"project_key", "repo_slug"}, nil),
+		teamMembersTotal:   prometheus.NewDesc("bitbucket_team_members_total", "Number of members per team or group", []string{"team_name"}, nil),
+	}
+}
+
+func (c *PermissionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.perUserAccessRepos
+	ch <- c.perUserDirectRepos
+	ch <- c.repoAdminsTotal
+	ch <- c.repoDirectGrants
+	ch <- c.teamMembersTotal
+}
+
+func (c *PermissionCollector) Collect(ch chan<- prometheus.Metric) {
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		log.Printf("error listing repositories for permissions: %v", err)
+		return
+	}
+	members, err := c.client.groupMembers()
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch group members, group grants are not expanded: %v", err)
+	}
+	for group, users := range members {
+		ch <- prometheus.MustNewConstMetric(c.teamMembersTotal, prometheus.GaugeValue, float64(len(users)), group)
+	}
+
+	var access []repoAccess
+	if c.client.Cloud {
+		access = c.cloudAccess(repos)
+	} else {
+		access = c.serverAccess(repos, members)
+	}
+
+	accessRepos := make(map[[2]string]int)
+	directRepos := make(map[[2]string]int)
+	for _, a := range access {
+		admins := 0
+		for user, level := range a.effective {
+			accessRepos[[2]string{user, level}]++
+			if level == "admin" {
+				admins++
+			}
+		}
+		for user, level := range a.direct {
+			directRepos[[2]string{user, level}]++
+		}
+		ch <- prometheus.MustNewConstMetric(c.repoAdminsTotal, prometheus.GaugeValue, float64(admins), a.repo.ProjectKey, a.repo.Slug)
+		ch <- prometheus.MustNewConstMetric(c.repoDirectGrants, prometheus.GaugeValue, float64(len(a.direct)), a.repo.ProjectKey, a.repo.Slug)
+	}
+	for k, n := range accessRepos {
+		ch <- prometheus.MustNewConstMetric(c.perUserAccessRepos, prometheus.GaugeValue, float64(n), k[0], k[1])
+	}
+	for k, n := range directRepos {
+		ch <- prometheus.MustNewConstMetric(c.perUserDirectRepos, prometheus.GaugeValue, float64(n), k[0], k[1])
+	}
+}
+
+// cloudAccess reads effective permissions from the workspace-wide listing and
+// direct user grants from each repository's permissions-config.
+func (c *PermissionCollector) cloudAccess(repos []Repository) []repoAccess {
+	bySlug := make(map[string]*repoAccess, len(repos))
+	access := make([]repoAccess, len(repos))
+	for i, repo := range repos {
+		access[i] = repoAccess{repo, make(map[string]string), make(map[string]string)}
+		bySlug[repo.Slug] = &access[i]
+	}
+
+	type cloudUser struct {
+		Nickname    string `json:"nickname"`
+		DisplayName string `json:"display_name"`
+	}
+	name := func(u cloudUser) string {
+		if u.Nickname != "" {
+			return u.Nickname
+		}
+		return u.DisplayName
+	}
+	perms, err := cloudPages[struct {
+		Permission string    `json:"permission"`
+		User       cloudUser `json:"user"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}](c.client, cloudAPIURL+"/workspaces/"+c.client.Workspace+"/permissions/repositories?pagelen=100")
+	if err != nil {
+		log.Printf("error fetching workspace repository permissions: %v", err)
+	}
+	for _, p := range perms {
+		slug := p.Repository.FullName[strings.LastIndex(p.Repository.FullName, "/")+1:]
+		if a, ok := bySlug[slug]; ok {
+			grantHighest(a.effective, name(p.User), normalisePermission(p.Permission))
+		}
+	}
+
+	for i := range access {
+		users, err := cloudPages[struct {
+			Permission string    `json:"permission"`
+			User       cloudUser `json:"user"`
+		}](c.client, c.client.repoPath(access[i].repo)+"/permissions-config/users?pagelen=100")
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch user permissions for %s: %v", access[i].repo.Slug, err)
+			continue
+		}
+		for _, u := range users {
+			grantHighest(access[i].direct, name(u.User), normalisePermission(u.Permission))
+		}
+	}
+	return access
+}
+
+// serverAccess combines the user and group permissions of each repository
+// and its project, expanding groups through their members.
+func (c *PermissionCollector) serverAccess(repos []Repository, members map[string][]string) []repoAccess {
+	projects := make(map[string]principalGrants)
+	var access []repoAccess
+	for _, repo := range repos {
+		project, ok := projects[repo.ProjectKey]
+		if !ok {
+			var err error
+			if project, err = c.client.serverGrants("/projects/" + url.PathEscape(repo.ProjectKey)); err != nil {
+				debugf(c.logLevel, "Failed to fetch permissions of project %s: %v", repo.ProjectKey, err)
+			}
+			projects[repo.ProjectKey] = project
+		}
+		own, err := c.client.serverGrants("/projects/" + url.PathEscape(repo.ProjectKey) + "/repos/" + url.PathEscape(repo.Slug))
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch permissions of %s: %v", repo.Slug, err)
+			continue
+		}
+		a := repoAccess{repo, make(map[string]string), own.users}
+		for _, grants := range []principalGrants{project, own} {
+			for user, level := range grants.users {
+				grantHighest(a.effective, user, level)
+			}
+			for group, level := range grants.groups {
+				for _, user := range members[group] {
+					grantHighest(a.effective, user, level)
+				}
+			}
+		}
+		access = append(access, a)
+	}
+	return access
+}
+
+// serverGrants reads the user and group permissions of a Data Center project or repository path.
+func (c *BitbucketClient) serverGrants(path string) (principalGrants, error) {
+	grants := principalGrants{make(map[string]string), make(map[string]string)}
+	users, err := serverPages[struct {
+		Permission string `json:"permission"`
+		User       struct {
+			Name string `json:"name"`
+		} `json:"user"`
+	}](c, c.BaseURL+"/rest/api/1.0"+path+"/permissions/users?limit=1000")
+	if err != nil {
+		return grants, err
+	}
+	for _, u := range users {
+		grantHighest(grants.users, u.User.Name, normalisePermission(u.Permission))
+	}
+	groups, err := serverPages[struct {
+		Permission string `json:"permission"`
+		Group      struct {
+			Name string `json:"name"`
+		} `json:"group"`
+	}](c, c.BaseURL+"/rest/api/1.0"+path+"/permissions/groups?limit=1000")
+	if err != nil {
+		return grants, err
+	}
+	for _, g := range groups {
+		grantHighest(grants.groups, g.Group.Name, normalisePermission(g.Permission))
+	}
+	return grants, nil
+}
+
+// groupMembers returns the members of every group. Cloud reads the 1.0
+// groups API; Data Center needs an admin account for /admin/groups. A Data
+// Center group whose members cannot be read is logged and left out, so only
+// its own grants go unexpanded.
+func (c *BitbucketClient) groupMembers() (map[string][]string, error) {
+	members := make(map[string][]string)
+	if c.Cloud {
+		var groups []struct {
+			Name    string `json:"name"`
+			Members []struct {
+				Nickname string `json:"nickname"`
+			} `json:"members"`
+		}
+		if err := c.getJSON(strings.TrimSuffix(cloudAPIURL, "2.0")+"1.0/groups/"+c.Workspace, &groups); err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			members[g.Name] = nil
+			for _, m := range g.Members {
+				members[g.Name] = append(members[g.Name], m.Nickname)
+			}
+		}
+		return members, nil
+	}
+	groups, err := serverPages[struct {
+		Name string `json:"name"`
+	}](c, c.BaseURL+"/rest/api/1.0/admin/groups?limit=1000")
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		name := g.Name
+		users, err := serverPages[struct {
+			Name string `json:"name"`
+		}](c, fmt.Sprintf("%s/rest/api/1.0/admin/groups/more-members?context=%s&limit=1000", c.BaseURL, url.QueryEscape(name)))
+		if err != nil {
+			log.Printf("error fetching members of group %s, its grants are not expanded: %v", name, err)
+			continue
+		}
+		members[name] = nil
+		for _, u := range users {
+			members[name] = append(members[name], u.Name)
+		}
+	}
+	return members, nil
+}
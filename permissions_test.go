@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// page wraps values in a single, last Data Center page.
+func page(values ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"values": values, "isLastPage": true}
+}
+
+func TestPermissionCollector_DataCenter(t *testing.T) {
+	user := func(name, perm string) interface{} {
+		return map[string]interface{}{"permission": perm, "user": map[string]string{"name": name}}
+	}
+	group := func(name, perm string) interface{} {
+		return map[string]interface{}{"permission": perm, "group": map[string]string{"name": name}}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{} = page()
+		switch r.URL.Path {
+		case "/rest/api/1.0/repos":
+			body = page(map[string]interface{}{"slug": "app", "project": map[string]string{"key": "PRJ"}})
+		case "/rest/api/1.0/admin/groups":
+			body = page(map[string]string{"name": "devs"}, map[string]string{"name": "broken"})
+		case "/rest/api/1.0/admin/groups/more-members":
+			if r.URL.Query().Get("context") == "broken" {
+				w.WriteHeader(500)
+				return
+			}
+			body = page(map[string]string{"name": "alice"}, map[string]string{"name": "bob"})
+		case "/rest/api/1.0/projects/PRJ/permissions/groups":
+			body = page(group("devs", "PROJECT_WRITE"), group("broken", "PROJECT_READ"))
+		case "/rest/api/1.0/projects/PRJ/permissions/users":
+			body = page(user("carol", "PROJECT_ADMIN"))
+		case "/rest/api/1.0/projects/PRJ/repos/app/permissions/users":
+			body = page(user("alice", "REPO_ADMIN"), user("dave", "REPO_READ"))
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+
+	out := scrape(t, NewPermissionCollector(client, "info"))
+	for _, want := range []string{
+		`bitbucket_team_members_total{team_name="devs"} 2`,
+		`bitbucket_repo_admins_total{project_key="PRJ",repo_slug="app"} 2`,
+		`bitbucket_repo_direct_user_grants_total{project_key="PRJ",repo_slug="app"} 2`,
+		`bitbucket_user_access_repos_total{permission_level="admin",user="alice"} 1`,
+		`bitbucket_user_access_repos_total{permission_level="write",user="bob"} 1`,
+		`bitbucket_user_access_repos_total{permission_level="admin",user="carol"} 1`,
+		`bitbucket_user_direct_access_repos_total{permission_level="read",user="dave"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q", want)
+		}
+	}
+	// A group whose members cannot be read does not stop the others from being expanded.
+	if strings.Contains(out, `team_name="broken"`) {
+		t.Errorf("unreadable group reported\n%s", out)
+	}
+}
+
+func TestPermissionCollector_Cloud(t *testing.T) {
+	nickname := func(name string) map[string]string { return map[string]string{"nickname": name} }
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/2.0/repositories/testws":
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"slug": "app", "name": "App", "project": map[string]string{"key": "PRJ"}},
+			}}
+		case "/1.0/groups/testws":
+			body = []interface{}{
+				map[string]interface{}{"name": "developers", "members": []interface{}{nickname("alice"), nickname("bob")}},
+				map[string]interface{}{"name": "empty", "members": []interface{}{}},
+			}
+		case "/2.0/workspaces/testws/permissions/repositories":
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"permission": "admin", "user": nickname("alice"), "repository": map[string]string{"full_name": "testws/app"}},
+				map[string]interface{}{"permission": "write", "user": nickname("bob"), "repository": map[string]string{"full_name": "testws/app"}},
+			}}
+		case "/2.0/repositories/testws/app/permissions-config/users":
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"permission": "admin", "user": nickname("alice")},
+			}}
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+
+	out := scrape(t, NewPermissionCollector(client, "info"))
+	for _, want := range []string{
+		`bitbucket_team_members_total{team_name="developers"} 2`,
+		`bitbucket_team_members_total{team_name="empty"} 0`,
+		`bitbucket_repo_admins_total{project_key="PRJ",repo_slug="app"} 1`,
+		`bitbucket_repo_direct_user_grants_total{project_key="PRJ",repo_slug="app"} 1`,
+		`bitbucket_user_access_repos_total{permission_level="write",user="bob"} 1`,
+		`bitbucket_user_direct_access_repos_total{permission_level="admin",user="alice"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pipelineMaxPages caps how many pages of pipeline history a single scrape walks per repo.
+const pipelineMaxPages = 10
+
+// pipelineStepFetches caps how many completed runs have their steps fetched
+// per scrape; the rest wait in the step backlog for later scrapes.
+const pipelineStepFetches = 20
+
+// pipelineStepBacklog caps the step backlog. A workspace that completes more
+// runs per scrape interval than are fetched would otherwise grow it without
+// bound; the oldest runs are dropped first.
+const pipelineStepBacklog = 5 * pipelineStepFetches
+
+// pipelineDurationBuckets cover quick lint runs up to multi-hour release builds.
+var pipelineDurationBuckets = []float64{30, 60, 120, 300, 600, 900, 1800, 3600, 7200}
+
+// pipelineQueueBuckets cover a warm runner picking work up immediately through long waits for capacity.
+var pipelineQueueBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1800}
+
+// selfHostedRunnerLabel is the runs-on label every self-hosted runner carries.
+const selfHostedRunnerLabel = "self.hosted"
+
+// cloudPipeline is the subset of a Bitbucket Cloud pipeline object the exporter reads.
+type cloudPipeline struct {
+	UUID        string `json:"uuid"`
+	BuildNumber int    `json:"build_number"`
+	CreatedOn   string `json:"created_on"`
+	CompletedOn string `json:"completed_on"`
+	State       struct {
+		Name   string `json:"name"`
+		Result struct {
+			Name string `json:"name"`
+		} `json:"result"`
+	} `json:"state"`
+	Trigger struct {
+		Name string `json:"name"`
+	} `json:"trigger"`
+	Target struct {
+		RefName string `json:"ref_name"`
+	} `json:"target"`
+	DurationInSeconds float64 `json:"duration_in_seconds"`
+	BuildSecondsUsed  float64 `json:"build_seconds_used"`
+}
+
+// cloudPipelineStep is the subset of a pipeline step object the exporter reads.
+type cloudPipelineStep struct {
+	Name        string `json:"name"`
+	StartedOn   string `json:"started_on"`
+	CompletedOn string `json:"completed_on"`
+	State       struct {
+		Name   string `json:"name"`
+		Result struct {
+			Name string `json:"name"`
+		} `json:"result"`
+	} `json:"state"`
+	RunsOn            []string `json:"runs_on"`
+	DurationInSeconds float64  `json:"duration_in_seconds"`
+}
+
+// runner reports whether the step ran on a self-hosted runner or on Atlassian's infrastructure.
+func (s cloudPipelineStep) runner() string {
+	for _, label := range s.RunsOn {
+		if label == selfHostedRunnerLabel {
+			return "self_hosted"
+		}
+	}
+	return "atlassian"
+}
+
+// pipelineCursor remembers which runs of a repo have already been counted.
+// Every build below watermark is final and counted; counted holds the builds
+// at or above it that completed while older runs were still in flight.
+type pipelineCursor struct {
+	watermark int
+	counted   map[int]bool
+}
+
+// pendingSteps is a completed run whose steps have not been recorded yet.
+type pendingSteps struct {
+	slug     string
+	pipeline cloudPipeline
+}
+
+// PipelineCollector tracks Bitbucket Cloud Pipelines runs. Completed runs are
+// counted once as they are discovered, so the counters only grow while the
+// exporter is running.
+type PipelineCollector struct {
+	client   *BitbucketClient
+	logLevel string
+
+	mu          sync.Mutex
+	cursors     map[string]*pipelineCursor
+	stepBacklog []pendingSteps
+
+	runsTotal        *prometheus.CounterVec
+	durationSeconds  *prometheus.HistogramVec
+	buildSecondsUsed *prometheus.CounterVec
+	activeTotal      *prometheus.Desc
+	branchActive     *prometheus.Desc
+
+	queueSeconds        *prometheus.HistogramVec
+	stepDurationSeconds *prometheus.HistogramVec
+	stepQueueSeconds    *prometheus.HistogramVec
+	stepFailuresTotal   *prometheus.CounterVec
+}
+
+func NewPipelineCollector(client *BitbucketClient, logLevel string) *PipelineCollector {
+	return &PipelineCollector{
+		client:   client,
+		logLevel: logLevel,
+		cursors:  make(map[string]*pipelineCursor),
+		runsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_pipeline_runs_total",
+			Help: "Number of completed pipeline runs by result and trigger",
+		}, []string{"repo_slug", "result", "trigger"}),
+		durationSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_pipeline_duration_seconds",
+			Help:    "Duration of completed pipeline runs",
+			Buckets: pipelineDurationBuckets,
+		}, []string{"repo_slug", "result"}),
+		buildSecondsUsed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_pipeline_build_seconds_used_total",
+			Help: "Build seconds consumed by completed pipeline runs",
+		}, []string{"repo_slug"}),
+		activeTotal:  prometheus.NewDesc("bitbucket_pipeline_active_total", "Currently pending or running pipelines", []string{"repo_slug", "state"}, nil),
+		branchActive: prometheus.NewDesc("bitbucket_pipeline_branch_active_total", "Currently pending or running pipelines per branch", []string{"repo_slug", "branch", "state"}, nil),
+		queueSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_pipeline_queue_seconds",
+			Help:    "Time from pipeline creation until its first step started",
+			Buckets: pipelineQueueBuckets,
+		}, []string{"repo_slug"}),
+		stepDurationSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_pipeline_step_duration_seconds",
+			Help:    "Duration of completed pipeline steps",
+			Buckets: pipelineDurationBuckets,
+		}, []string{"repo_slug", "step_name", "runner"}),
+		stepQueueSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_pipeline_step_queue_seconds",
+			Help:    "Time a pipeline step waited for a runner after it became ready",
+			Buckets: pipelineQueueBuckets,
+		}, []string{"repo_slug", "runner"}),
+		stepFailuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_pipeline_step_failures_total",
+			Help: "Number of pipeline steps that ended FAILED or ERROR",
+		}, []string{"repo_slug", "step_name", "result"}),
+	}
+}
+
+func (c *PipelineCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.runsTotal.Describe(ch)
+	c.durationSeconds.Describe(ch)
+	c.buildSecondsUsed.Describe(ch)
+	ch <- c.activeTotal
+	ch <- c.branchActive
+	c.queueSeconds.Describe(ch)
+	c.stepDurationSeconds.Describe(ch)
+	c.stepQueueSeconds.Describe(ch)
+	c.stepFailuresTotal.Describe(ch)
+}
+
+func (c *PipelineCollector) Collect(ch chan<- prometheus.Metric) {
+	// Pipelines only exist on Bitbucket Cloud.
+	if !c.client.Cloud {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		log.Printf("error listing repositories for pipelines: %v", err)
+	}
+	for _, repo := range repos {
+		active, err := c.scanRepo(repo.Slug)
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch pipelines for %s: %v", repo.Slug, err)
+			continue
+		}
+		perState := make(map[string]int)
+		for key, n := range active {
+			perState[key[0]] += n
+			ch <- prometheus.MustNewConstMetric(c.branchActive, prometheus.GaugeValue, float64(n), repo.Slug, key[1], key[0])
+		}
+		for _, state := range []string{"PENDING", "IN_PROGRESS"} {
+			ch <- prometheus.MustNewConstMetric(c.activeTotal, prometheus.GaugeValue, float64(perState[state]), repo.Slug, state)
+		}
+	}
+	c.drainStepBacklog()
+	c.runsTotal.Collect(ch)
+	c.durationSeconds.Collect(ch)
+	c.buildSecondsUsed.Collect(ch)
+	c.queueSeconds.Collect(ch)
+	c.stepDurationSeconds.Collect(ch)
+	c.stepQueueSeconds.Collect(ch)
+	c.stepFailuresTotal.Collect(ch)
+}
+
+// scanRepo walks the pipelines of a repo newest first, back to the cursor's
+// watermark, counts runs that completed since the last scan and returns the
+// active runs keyed by [state, branch].
+func (c *PipelineCollector) scanRepo(slug string) (map[[2]string]int, error) {
+	cur, ok := c.cursors[slug]
+	maxPages := pipelineMaxPages
+	if !ok {
+		// First sight of this repo: seed from the most recent page only
+		// instead of replaying the whole history.
+		cur = &pipelineCursor{counted: make(map[int]bool)}
+		maxPages = 1
+	}
+
+	active := make(map[[2]string]int)
+	maxSeen, minActive := 0, 0
+	url := fmt.Sprintf("%s/repositories/%s/%s/pipelines/?sort=-created_on&pagelen=100", cloudAPIURL, c.client.Workspace, slug)
+	for page := 0; url != "" && page < maxPages; page++ {
+		var data struct {
+			Values []cloudPipeline `json:"values"`
+			Next   string          `json:"next"`
+		}
+		if err := c.client.getJSON(url, &data); err != nil {
+			return nil, err
+		}
+		url = data.Next
+		for _, p := range data.Values {
+			if p.BuildNumber < cur.watermark {
+				url = ""
+				break
+			}
+			if p.BuildNumber > maxSeen {
+				maxSeen = p.BuildNumber
+			}
+			if p.State.Name != "COMPLETED" {
+				active[[2]string{p.State.Name, p.Target.RefName}]++
+				if minActive == 0 || p.BuildNumber < minActive {
+					minActive = p.BuildNumber
+				}
+				continue
+			}
+			if cur.counted[p.BuildNumber] {
+				continue
+			}
+			cur.counted[p.BuildNumber] = true
+			c.runsTotal.WithLabelValues(slug, p.State.Result.Name, p.Trigger.Name).Inc()
+			c.durationSeconds.WithLabelValues(slug, p.State.Result.Name).Observe(p.DurationInSeconds)
+			c.buildSecondsUsed.WithLabelValues(slug).Add(p.BuildSecondsUsed)
+			c.stepBacklog = append(c.stepBacklog, pendingSteps{slug, p})
+		}
+	}
+
+	switch {
+	case minActive > 0:
+		cur.watermark = minActive
+	case maxSeen > 0:
+		cur.watermark = maxSeen + 1
+	}
+	for n := range cur.counted {
+		if n < cur.watermark {
+			delete(cur.counted, n)
+		}
+	}
+	c.cursors[slug] = cur
+	return active, nil
+}
+
+// drainStepBacklog records the steps of up to pipelineStepFetches completed
+// runs, oldest discovery first, so a burst of finished runs does not stall a
+// single scrape. Runs beyond pipelineStepBacklog are dropped, oldest first.
+func (c *PipelineCollector) drainStepBacklog() {
+	if over := len(c.stepBacklog) - pipelineStepBacklog; over > 0 {
+		debugf(c.logLevel, "Step backlog full; skipping the steps of %d pipeline runs", over)
+		c.stepBacklog = c.stepBacklog[over:]
+	}
+	n := min(len(c.stepBacklog), pipelineStepFetches)
+	for _, r := range c.stepBacklog[:n] {
+		if err := c.recordSteps(r.slug, r.pipeline); err != nil {
+			debugf(c.logLevel, "Failed to fetch steps of pipeline %d in %s: %v", r.pipeline.BuildNumber, r.slug, err)
+		}
+	}
+	c.stepBacklog = c.stepBacklog[n:]
+}
+
+// recordSteps fetches the steps of a completed run and records step durations,
+// failures and queue times, plus the run's own queue time.
+//
+// The API does not say when a step became runnable, so a step is considered
+// ready when the latest step that finished before it started completed, or
+// when the pipeline was created if no such step exists.
+func (c *PipelineCollector) recordSteps(slug string, p cloudPipeline) error {
+	url := fmt.Sprintf("%s/repositories/%s/%s/pipelines/%s/steps/?pagelen=100", cloudAPIURL, c.client.Workspace, slug, p.UUID)
+	steps, err := cloudPages[cloudPipelineStep](c.client, url)
+	if err != nil {
+		return err
+	}
+	created, err := time.Parse(time.RFC3339, p.CreatedOn)
+	if err != nil {
+		return err
+	}
+	var firstStart time.Time
+	for _, s := range steps {
+		runner := s.runner()
+		started, err := time.Parse(time.RFC3339, s.StartedOn)
+		if err != nil {
+			// Skipped steps never start and have no duration or queue time.
+			continue
+		}
+		if s.State.Name == "COMPLETED" {
+			c.stepDurationSeconds.WithLabelValues(slug, s.Name, runner).Observe(s.DurationInSeconds)
+			if r := s.State.Result.Name; r == "FAILED" || r == "ERROR" {
+				c.stepFailuresTotal.WithLabelValues(slug, s.Name, r).Inc()
+			}
+		}
+		if firstStart.IsZero() || started.Before(firstStart) {
+			firstStart = started
+		}
+		ready := created
+		for _, prev := range steps {
+			done, err := time.Parse(time.RFC3339, prev.CompletedOn)
+			if err == nil && done.After(ready) && !done.After(started) {
+				ready = done
+			}
+		}
+		c.stepQueueSeconds.WithLabelValues(slug, runner).Observe(started.Sub(ready).Seconds())
+	}
+	if !firstStart.IsZero() {
+		c.queueSeconds.WithLabelValues(slug).Observe(firstStart.Sub(created).Seconds())
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newCloudTestClient points the Cloud API at an httptest server for the duration of the test.
+func newCloudTestClient(t *testing.T, h http.Handler) *BitbucketClient {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	orig := cloudAPIURL
+	cloudAPIURL = ts.URL + "/2.0"
+	t.Cleanup(func() { cloudAPIURL = orig })
+	return NewBitbucketClient(&Config{Workspace: "testws"}, true)
+}
+
+// scrape registers the collector in a private registry and returns the text exposition.
+func scrape(t *testing.T, c prometheus.Collector) string {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestPipelineCollector_CountsCompletedRunsOnce(t *testing.T) {
+	pipelines := []map[string]interface{}{
+		{"build_number": 3, "state": map[string]interface{}{"name": "IN_PROGRESS"}, "target": map[string]interface{}{"ref_name": "main"}},
+		{"build_number": 2, "state": map[string]interface{}{"name": "COMPLETED", "result": map[string]interface{}{"name": "FAILED"}}, "trigger": map[string]interface{}{"name": "PUSH"}, "duration_in_seconds": 90, "build_seconds_used": 80},
+		{"build_number": 1, "state": map[string]interface{}{"name": "COMPLETED", "result": map[string]interface{}{"name": "SUCCESSFUL"}}, "trigger": map[string]interface{}{"name": "PUSH"}, "duration_in_seconds": 40, "build_seconds_used": 30},
+	}
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2.0/repositories/testws":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"slug": "app", "name": "App", "project": map[string]interface{}{"key": "PRJ"}},
+			}})
+		case "/2.0/repositories/testws/app/pipelines/":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": pipelines})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	c := NewPipelineCollector(client, "info")
+
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_pipeline_runs_total{repo_slug="app",result="FAILED",trigger="PUSH"} 1`,
+		`bitbucket_pipeline_runs_total{repo_slug="app",result="SUCCESSFUL",trigger="PUSH"} 1`,
+		`bitbucket_pipeline_build_seconds_used_total{repo_slug="app"} 110`,
+		`bitbucket_pipeline_active_total{repo_slug="app",state="IN_PROGRESS"} 1`,
+		`bitbucket_pipeline_branch_active_total{branch="main",repo_slug="app",state="IN_PROGRESS"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("first scrape missing %q", want)
+		}
+	}
+
+	// Build 3 finishes; builds 1 and 2 must not be counted again.
+	pipelines[0] = map[string]interface{}{"build_number": 3, "state": map[string]interface{}{"name": "COMPLETED", "result": map[string]interface{}{"name": "SUCCESSFUL"}}, "trigger": map[string]interface{}{"name": "PUSH"}, "duration_in_seconds": 60, "build_seconds_used": 50}
+	out = scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_pipeline_runs_total{repo_slug="app",result="FAILED",trigger="PUSH"} 1`,
+		`bitbucket_pipeline_runs_total{repo_slug="app",result="SUCCESSFUL",trigger="PUSH"} 2`,
+		`bitbucket_pipeline_build_seconds_used_total{repo_slug="app"} 160`,
+		`bitbucket_pipeline_active_total{repo_slug="app",state="IN_PROGRESS"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("second scrape missing %q", want)
+		}
+	}
+}
+
+func TestPipelineCollector_RecordsSteps(t *testing.T) {
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	at := func(seconds int) string {
+		return created.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339)
+	}
+	step := func(name string, start, end int, result string, runsOn ...string) map[string]interface{} {
+		return map[string]interface{}{
+			"name": name, "started_on": at(start), "completed_on": at(end), "duration_in_seconds": end - start, "runs_on": runsOn,
+			"state": map[string]interface{}{"name": "COMPLETED", "result": map[string]interface{}{"name": result}},
+		}
+	}
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2.0/repositories/testws":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"slug": "app", "name": "App", "project": map[string]interface{}{"key": "PRJ"}},
+			}})
+		case "/2.0/repositories/testws/app/pipelines/":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{map[string]interface{}{
+				"uuid": "{p1}", "build_number": 1, "created_on": at(0), "trigger": map[string]interface{}{"name": "PUSH"},
+				"state": map[string]interface{}{"name": "COMPLETED", "result": map[string]interface{}{"name": "FAILED"}},
+			}}})
+		case "/2.0/repositories/testws/app/pipelines/{p1}/steps/":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				step("build", 10, 70, "SUCCESSFUL"),
+				// Ready when build completed at 70s, so it queued for 30s.
+				step("test", 100, 150, "FAILED", "self.hosted", "linux"),
+				map[string]interface{}{"name": "deploy", "state": map[string]interface{}{"name": "COMPLETED", "result": map[string]interface{}{"name": "NOT_RUN"}}},
+			}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	c := NewPipelineCollector(client, "info")
+
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_pipeline_queue_seconds_sum{repo_slug="app"} 10`,
+		`bitbucket_pipeline_step_duration_seconds_sum{repo_slug="app",runner="atlassian",step_name="build"} 60`,
+		`bitbucket_pipeline_step_duration_seconds_sum{repo_slug="app",runner="self_hosted",step_name="test"} 50`,
+		`bitbucket_pipeline_step_queue_seconds_sum{repo_slug="app",runner="atlassian"} 10`,
+		`bitbucket_pipeline_step_queue_seconds_sum{repo_slug="app",runner="self_hosted"} 30`,
+		`bitbucket_pipeline_step_failures_total{repo_slug="app",result="FAILED",step_name="test"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `step_name="deploy"`) {
+		t.Errorf("skipped step was recorded")
+	}
+}
+
+func TestPipelineCollector_CapsStepBacklog(t *testing.T) {
+	var fetched []string
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{}})
+	}))
+	c := NewPipelineCollector(client, "info")
+	for n := 1; n <= 3*pipelineStepBacklog; n++ {
+		c.stepBacklog = append(c.stepBacklog, pendingSteps{"app", cloudPipeline{UUID: fmt.Sprintf("{p%d}", n), BuildNumber: n}})
+	}
+
+	c.drainStepBacklog()
+	if len(fetched) != pipelineStepFetches {
+		t.Fatalf("fetched steps of %d runs, want %d", len(fetched), pipelineStepFetches)
+	}
+	// The oldest runs beyond the cap are dropped, then the oldest kept are fetched.
+	firstKept := 2*pipelineStepBacklog + 1
+	if want := fmt.Sprintf("/2.0/repositories/testws/app/pipelines/{p%d}/steps/", firstKept); fetched[0] != want {
+		t.Errorf("first fetch = %s, want %s", fetched[0], want)
+	}
+	if got, want := len(c.stepBacklog), pipelineStepBacklog-pipelineStepFetches; got != want {
+		t.Errorf("backlog holds %d runs, want %d", got, want)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// repoSnapshot is the last set of per-repository metrics fetched for one repo.
+type repoSnapshot struct {
+	metrics     []prometheus.Metric
+	credentials []credential // reported at collection time, as their ages keep growing
+	healthy     bool
+	fetchedAt   time.Time // when fetching started, to tell overlapping refreshes apart
+}
+
+// RefreshRepo re-fetches the per-repository metrics (open PRs, commits, size,
+// last commit, settings, issues, tags, branches, branch policy, review
+// coverage, build statuses and credentials) of a single repository and replaces its cached snapshot. The
+// polling cycle in Collect and webhook-triggered refreshes both go through here.
+func (c *BitbucketCollector) RefreshRepo(projectKey, slug string) error {
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if repo.ProjectKey == projectKey && repo.Slug == slug {
+			c.refreshRepo(repo)
+			return nil
+		}
+	}
+	return fmt.Errorf("repository %s/%s not found", projectKey, slug)
+}
+
+// refreshRepo fetches and caches the snapshot of one repository, unless a
+// refresh that started later has already cached a newer one.
+func (c *BitbucketCollector) refreshRepo(repo Repository) repoSnapshot {
+	snap := repoSnapshot{healthy: true, fetchedAt: time.Now()}
+	// Resolved once and shared by every helper; empty when it cannot be resolved.
+	branch, head, err := c.client.DefaultBranch(repo)
+	if err != nil {
+		debugf(c.logLevel, "Failed to resolve default branch for %s: %v", repo.Slug, err)
+	}
+	if c.client.Cloud {
+		snap.metrics, snap.healthy = c.fetchRepoMetrics(repo)
+	} else if settings, err := c.client.serverRepoSettings(repo, branch); err != nil {
+		debugf(c.logLevel, "Failed to fetch settings for %s: %v", repo.Slug, err)
+	} else {
+		snap.metrics = c.repoSettingsMetrics(repo, settings)
+	}
+	if !c.client.Cloud {
+		snap.metrics = append(snap.metrics, c.serverSizeMetrics(repo)...)
+	}
+	snap.metrics = append(snap.metrics, c.branchMetrics(repo, branch)...)
+	snap.metrics = append(snap.metrics, c.branchPolicyMetrics(repo, branch)...)
+	// Open pull requests are shared by review coverage and build statuses.
+	prs, err := c.client.OpenPullRequests(repo)
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch open pull requests for %s: %v", repo.Slug, err)
+	}
+	snap.metrics = append(snap.metrics, c.reviewerMetrics(repo, head, prs, err == nil)...)
+	snap.metrics = append(snap.metrics, c.buildStatusMetrics(repo, branch, head, prs)...)
+	snap.credentials = c.repoCredentials(repo)
+	key := repo.ProjectKey + "/" + repo.Slug
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	if cached, ok := c.snapshots[key]; ok && cached.fetchedAt.After(snap.fetchedAt) {
+		return cached
+	}
+	c.snapshots[key] = snap
+	return snap
+}
+
+// refreshAll runs a full polling cycle over every repository and drops the
+// snapshots of repositories that no longer exist. Snapshots written by
+// webhook-triggered refreshes during the walk are kept when they are newer.
+// It releases the claim taken by claimFullRefresh.
+func (c *BitbucketCollector) refreshAll(repos []Repository) {
+	fresh := make(map[string]repoSnapshot, len(repos))
+	for _, repo := range repos {
+		fresh[repo.ProjectKey+"/"+repo.Slug] = c.refreshRepo(repo)
+	}
+	c.refreshProjectCredentials()
+	c.snapshotMu.Lock()
+	for key, snap := range fresh {
+		if cached, ok := c.snapshots[key]; ok && cached.fetchedAt.After(snap.fetchedAt) {
+			fresh[key] = cached
+		}
+	}
+	c.snapshots = fresh
+	c.lastFullRefresh = time.Now()
+	c.fullRefreshing = false
+	c.snapshotMu.Unlock()
+	c.activity.markPrimed()
+	c.sizeHistory.save()
+}
+
+// collectSnapshots emits every cached per-repository metric, and the
+// credentials of every repository and project, and reports whether all
+// snapshots were fetched cleanly.
+func (c *BitbucketCollector) collectSnapshots(ch chan<- prometheus.Metric) bool {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	healthy := true
+	creds := append([]credential(nil), c.projectCredentials...)
+	for _, snap := range c.snapshots {
+		for _, m := range snap.metrics {
+			ch <- m
+		}
+		creds = append(creds, snap.credentials...)
+		healthy = healthy && snap.healthy
+	}
+	c.collectCredentials(ch, creds)
+	return healthy
+}
+
+// claimFullRefresh reports whether the cached snapshots are older than the
+// refresh interval and no full cycle is running, and if so marks one in
+// flight. Overlapping scrapes then serve the cache instead of walking every
+// repository again; refreshAll releases the claim.
+func (c *BitbucketCollector) claimFullRefresh() bool {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	if c.fullRefreshing || time.Since(c.lastFullRefresh) < c.refreshInterval {
+		return false
+	}
+	c.fullRefreshing = true
+	return true
+}
+
+// fetchRepoMetrics performs the Cloud-only API calls behind the per-repository
+// metrics. healthy is false when a call the exporter relies on failed.
+func (c *BitbucketCollector) fetchRepoMetrics(repo Repository) (metrics []prometheus.Metric, healthy bool) {
+	healthy = true
+	base := c.client.repoPath(repo)
+
+	// Open PRs per repo
+	var prData struct {
+		Size int `json:"size"`
+	}
+	if err := c.client.getJSON(base+"/pullrequests?state=OPEN&pagelen=1", &prData); err != nil {
+		debugf(c.logLevel, "Failed to fetch open PRs for %s: %v", repo.Slug, err)
+	}
+	metrics = append(metrics, prometheus.MustNewConstMetric(
+		c.perRepoPRs, prometheus.GaugeValue, float64(prData.Size), repo.ProjectKey, repo.ProjectName, repo.Slug, repo.Name))
+
+	// Commits per repo and user (aggregate before emitting)
+	commitsURL := base + "/commits?pagelen=100"
+	totalCommits := 0
+	committerMap := make(map[string]int)
+	for commitsURL != "" {
+		var commitData struct {
+			Values []struct {
+				Date   string `json:"date"`
+				Author struct {
+					Raw  string `json:"raw"`
+					User struct {
+						AccountID string `json:"account_id"`
+					} `json:"user"`
+				} `json:"author"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}
+		if err := c.client.getJSON(commitsURL, &commitData); err != nil {
+			debugf(c.logLevel, "Failed to fetch commits for %s: %v", repo.Slug, err)
+			break
+		}
+		totalCommits += len(commitData.Values)
+		for _, commit := range commitData.Values {
+			committerMap[commit.Author.Raw]++
+			date, _ := time.Parse(time.RFC3339, commit.Date)
+			if id := commit.Author.User.AccountID; id != "" {
+				c.activity.observe(id, date)
+			} else {
+				c.activity.observe(authorNameKey(rawAuthorName(commit.Author.Raw)), date)
+			}
+		}
+		commitsURL = commitData.Next
+	}
+
+	// Pull requests authored within the dormancy window, whatever their state
+	if c.dormantDays > 0 {
+		prs, err := c.client.PullRequestsCreatedSince(repo, time.Now().AddDate(0, 0, -c.dormantDays))
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch recent pull requests for %s: %v", repo.Slug, err)
+		}
+		for _, pr := range prs {
+			c.activity.observe(pr.AuthorID, pr.CreatedOn)
+		}
+	}
+	metrics = append(metrics, prometheus.MustNewConstMetric(
+		c.perRepoCommits, prometheus.GaugeValue, float64(totalCommits), repo.ProjectKey, repo.ProjectName, repo.Slug, repo.Name))
+	for user, count := range committerMap {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			c.perUserCommits, prometheus.GaugeValue, float64(count), repo.ProjectKey, repo.ProjectName, repo.Slug, repo.Name, user))
+	}
+
+	// Per-repo size and settings
+	var repoInfo cloudRepoObject
+	if err := c.client.getJSON(base, &repoInfo); err != nil {
+		log.Printf("Failed to fetch repo info for %s: %v", repo.Slug, err)
+		return metrics, false
+	}
+	metrics = append(metrics, c.sizeMetrics(repo, repoInfo.Size)...)
+	metrics = append(metrics, c.repoSettingsMetrics(repo, repoInfo.settings())...)
+
+	// Last commit timestamp
+	var lastCommit struct {
+		Values []struct {
+			Date string `json:"date"`
+		} `json:"values"`
+	}
+	if err := c.client.getJSON(base+"/commits?pagelen=1", &lastCommit); err != nil {
+		log.Printf("Failed to fetch last commit for %s: %v", repo.Slug, err)
+		return metrics, false
+	}
+	if len(lastCommit.Values) > 0 {
+		ts, err := parseRFC3339ToUnix(lastCommit.Values[0].Date)
+		if err == nil {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				c.perRepoLastCommit, prometheus.GaugeValue, float64(ts), repo.ProjectKey, repo.ProjectName, repo.Slug, repo.Name))
+		} else {
+			log.Printf("Failed to parse commit date for %s: %v", repo.Slug, err)
+			healthy = false
+		}
+	}
+
+	// Issues (open), only when the issue tracker is enabled
+	var issuesData struct {
+		Size int `json:"size"`
+	}
+	if err := c.client.getJSON(base+"/issues?state=open", &issuesData); err == nil {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			c.issuesTotal, prometheus.GaugeValue, float64(issuesData.Size), repo.Slug, "open"))
+	}
+
+	// Releases (tags)
+	var tagsData struct {
+		Size int `json:"size"`
+	}
+	if err := c.client.getJSON(base+"/refs/tags?pagelen=100", &tagsData); err == nil {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			c.releasesTotal, prometheus.GaugeValue, float64(tagsData.Size), repo.Slug))
+	}
+
+	// Branch deleted (not available in API, log warning)
+	debugf(c.logLevel, "Branch deleted metric not available in Bitbucket Cloud API; skipping.")
+	return metrics, healthy
+}
+
+// refreshState is where a repo is in the webhook refresh cycle.
+type refreshState int
+
+const (
+	refreshScheduled refreshState = iota + 1 // waiting out the debounce window
+	refreshRunning                           // refresh in flight
+	refreshRerun                             // in flight, and triggered again meanwhile
+)
+
+// repoRefresher coalesces webhook-triggered refreshes. The first event for a
+// repo schedules a refresh after the debounce window; further events for the
+// same repo inside the window are folded into it. A repo stays marked until
+// its refresh has finished, so refreshes of one repo never overlap; an event
+// arriving while one runs schedules a single follow-up refresh.
+type repoRefresher struct {
+	refresh func(projectKey, slug string) error
+	window  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]refreshState
+}
+
+func newRepoRefresher(refresh func(projectKey, slug string) error, window time.Duration) *repoRefresher {
+	return &repoRefresher{
+		refresh: refresh,
+		window:  window,
+		pending: make(map[string]refreshState),
+	}
+}
+
+// Trigger schedules a refresh of the repository unless one is already pending.
+func (r *repoRefresher) Trigger(projectKey, slug string) {
+	key := projectKey + "/" + slug
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.pending[key] {
+	case refreshScheduled, refreshRerun:
+		return
+	case refreshRunning:
+		r.pending[key] = refreshRerun
+		return
+	}
+	r.schedule(projectKey, slug)
+}
+
+// schedule runs a refresh after the debounce window. r.mu must be held.
+func (r *repoRefresher) schedule(projectKey, slug string) {
+	key := projectKey + "/" + slug
+	r.pending[key] = refreshScheduled
+	time.AfterFunc(r.window, func() {
+		r.mu.Lock()
+		r.pending[key] = refreshRunning
+		r.mu.Unlock()
+		if err := r.refresh(projectKey, slug); err != nil {
+			log.Printf("error refreshing %s: %v", key, err)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.pending[key] == refreshRerun {
+			r.schedule(projectKey, slug)
+			return
+		}
+		delete(r.pending, key)
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefreshRepo_Cloud(t *testing.T) {
+	var mu sync.Mutex
+	branchLookups, openPRLookups := 0, 0
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/2.0/repositories/testws":
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"uuid": "{1}", "slug": "app", "name": "App", "project": map[string]interface{}{"key": "PRJ", "name": "Project"}},
+			}}
+		case "/2.0/repositories/testws/app":
+			body = map[string]interface{}{"size": 2048, "is_private": true, "mainbranch": map[string]string{"name": "main"}}
+		case "/2.0/repositories/testws/app/refs/branches/main":
+			mu.Lock()
+			branchLookups++
+			mu.Unlock()
+			body = map[string]interface{}{"target": map[string]string{"hash": "h1"}}
+		case "/2.0/repositories/testws/app/pullrequests":
+			if r.URL.Query().Get("pagelen") == "50" {
+				mu.Lock()
+				openPRLookups++
+				mu.Unlock()
+			}
+			body = map[string]interface{}{"size": 2, "values": []interface{}{}}
+		case "/2.0/repositories/testws/app/commits":
+			body = map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"date": "2024-05-02T10:00:00+00:00", "author": map[string]string{"raw": "Alice <alice@example.com>"}},
+				map[string]interface{}{"date": "2024-05-01T10:00:00+00:00", "author": map[string]string{"raw": "Bob <bob@example.com>"}},
+			}}
+		case "/2.0/repositories/testws/app/issues":
+			body = map[string]interface{}{"size": 3}
+		case "/2.0/repositories/testws/app/refs/tags":
+			body = map[string]interface{}{"size": 4}
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	c := NewBitbucketCollector(client, &Config{}, "info", 0)
+
+	if err := c.RefreshRepo("PRJ", "app"); err != nil {
+		t.Fatal(err)
+	}
+	snap := c.snapshots["PRJ/app"]
+	if !snap.healthy {
+		t.Errorf("snapshot unhealthy")
+	}
+	if branchLookups != 1 {
+		t.Errorf("default branch resolved %d times, want once per refresh", branchLookups)
+	}
+	if openPRLookups != 1 {
+		t.Errorf("open pull requests listed %d times, want once per refresh", openPRLookups)
+	}
+	out := scrape(t, staticCollector(snap.metrics))
+	for _, want := range []string{
+		`bitbucket_repo_open_prs{project_key="PRJ",project_name="Project",repo_name="App",repo_slug="app"} 2`,
+		`bitbucket_repo_commits{project_key="PRJ",project_name="Project",repo_name="App",repo_slug="app"} 2`,
+		`bitbucket_user_commits{project_key="PRJ",project_name="Project",repo_name="App",repo_slug="app",user="Alice <alice@example.com>"} 1`,
+		`bitbucket_repo_size_bytes{project_key="PRJ",project_name="Project",repo_name="App",repo_slug="app"} 2048`,
+		`bitbucket_repo_last_commit_timestamp{project_key="PRJ",project_name="Project",repo_name="App",repo_slug="app"} 1.714644e+09`,
+		`bitbucket_issues_total{repo_slug="app",status="open"} 3`,
+		`bitbucket_releases_total{repo_slug="app"} 4`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("snapshot missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestRefreshAll_KeepsNewerSnapshots(t *testing.T) {
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	c := NewBitbucketCollector(client, &Config{}, "info", 0)
+	// A webhook-triggered refresh that started after the full walk.
+	newer := time.Now().Add(time.Hour)
+	c.snapshots["PRJ/app"] = repoSnapshot{healthy: true, fetchedAt: newer}
+	c.snapshots["PRJ/gone"] = repoSnapshot{healthy: true, fetchedAt: newer}
+
+	c.refreshAll([]Repository{{ProjectKey: "PRJ", Slug: "app"}, {ProjectKey: "PRJ", Slug: "lib"}})
+	if got := c.snapshots["PRJ/app"].fetchedAt; !got.Equal(newer) {
+		t.Errorf("newer snapshot replaced by the full walk's (fetched at %v)", got)
+	}
+	if _, ok := c.snapshots["PRJ/lib"]; !ok {
+		t.Errorf("snapshot of lib missing")
+	}
+	if _, ok := c.snapshots["PRJ/gone"]; ok {
+		t.Errorf("snapshot of a repository that no longer exists kept")
+	}
+}
+
+func TestClaimFullRefresh_OnePerCycle(t *testing.T) {
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	c := NewBitbucketCollector(client, &Config{}, "info", time.Hour)
+
+	if !c.claimFullRefresh() {
+		t.Fatal("first full refresh not claimed")
+	}
+	// An overlapping scrape while the walk is in flight.
+	if c.claimFullRefresh() {
+		t.Error("second full refresh claimed while the first is running")
+	}
+	c.refreshAll(nil)
+	if c.claimFullRefresh() {
+		t.Error("full refresh claimed before the refresh interval elapsed")
+	}
+	c.snapshotMu.Lock()
+	c.lastFullRefresh = time.Now().Add(-2 * time.Hour)
+	c.snapshotMu.Unlock()
+	if !c.claimFullRefresh() {
+		t.Error("full refresh not claimed once the interval elapsed")
+	}
+}
+
+func TestRepoRefresher_CoalescesBursts(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	r := newRepoRefresher(func(projectKey, slug string) error {
+		mu.Lock()
+		calls[projectKey+"/"+slug]++
+		mu.Unlock()
+		return nil
+	}, 20*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		r.Trigger("PRJ", "app")
+	}
+	r.Trigger("PRJ", "lib")
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["PRJ/app"] != 1 || calls["PRJ/lib"] != 1 {
+		t.Errorf("expected one refresh per repo, got %v", calls)
+	}
+}
+
+func TestRepoRefresher_NoOverlap(t *testing.T) {
+	var mu sync.Mutex
+	calls, running, overlapped := 0, 0, false
+	started := make(chan struct{}, 4)
+	r := newRepoRefresher(func(projectKey, slug string) error {
+		mu.Lock()
+		calls++
+		running++
+		overlapped = overlapped || running > 1
+		mu.Unlock()
+		started <- struct{}{}
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}, 10*time.Millisecond)
+
+	r.Trigger("PRJ", "app")
+	<-started
+	// Events during the running refresh fold into one follow-up refresh.
+	r.Trigger("PRJ", "app")
+	r.Trigger("PRJ", "app")
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if overlapped {
+		t.Errorf("refreshes of the same repo overlapped")
+	}
+	if calls != 2 {
+		t.Errorf("expected the running refresh plus one follow-up, got %d", calls)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// repoSettingNames are the repository settings reported in bitbucket_repo_info
+// and checkable through BITBUCKET_REPO_RULES.
+var repoSettingNames = []string{"is_private", "fork_policy", "has_issues", "has_wiki", "mainbranch"}
+
+// repoSettings are the security-relevant settings of a repository. Settings a
+// flavor does not have (issues and wiki on Data Center) are left out of values.
+type repoSettings struct {
+	values    map[string]string
+	createdOn time.Time
+	updatedOn time.Time
+}
+
+// cloudRepoObject is the part of the Cloud repository object read for size and settings.
+type cloudRepoObject struct {
+	Size       int64  `json:"size"`
+	IsPrivate  bool   `json:"is_private"`
+	ForkPolicy string `json:"fork_policy"`
+	HasIssues  bool   `json:"has_issues"`
+	HasWiki    bool   `json:"has_wiki"`
+	MainBranch *struct {
+		Name string `json:"name"`
+	} `json:"mainbranch"`
+	CreatedOn string `json:"created_on"`
+	UpdatedOn string `json:"updated_on"`
+}
+
+func (r cloudRepoObject) settings() repoSettings {
+	s := repoSettings{values: map[string]string{
+		"is_private":  boolToString(r.IsPrivate),
+		"fork_policy": r.ForkPolicy,
+		"has_issues":  boolToString(r.HasIssues),
+		"has_wiki":    boolToString(r.HasWiki),
+		"mainbranch":  "",
+	}}
+	if r.MainBranch != nil {
+		s.values["mainbranch"] = r.MainBranch.Name
+	}
+	s.createdOn, _ = time.Parse(time.RFC3339, r.CreatedOn)
+	s.updatedOn, _ = time.Parse(time.RFC3339, r.UpdatedOn)
+	return s
+}
+
+// serverRepoSettings reads the settings of a Data Center repository whose
+// default branch is defaultBranch, empty if unknown. Fork policy is mapped
+// onto the Cloud values: allow_forks or no_forks.
+func (c *BitbucketClient) serverRepoSettings(repo Repository, defaultBranch string) (repoSettings, error) {
+	var data struct {
+		Public   bool `json:"public"`
+		Forkable bool `json:"forkable"`
+	}
+	if err := c.getJSON(c.repoPath(repo), &data); err != nil {
+		return repoSettings{}, err
+	}
+	forkPolicy := "no_forks"
+	if data.Forkable {
+		forkPolicy = "allow_forks"
+	}
+	s := repoSettings{values: map[string]string{
+		"is_private":  boolToString(!data.Public),
+		"fork_policy": forkPolicy,
+	}}
+	if defaultBranch != "" {
+		s.values["mainbranch"] = defaultBranch
+	}
+	return s, nil
+}
+
+// parseRepoRules parses a comma-separated list of setting=expected pairs.
+func parseRepoRules(s string) (map[string]string, error) {
+	rules := make(map[string]string)
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		name, want, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("rule %q: expected setting=value", f)
+		}
+		known := false
+		for _, n := range repoSettingNames {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown repository setting %q", name)
+		}
+		rules[name] = want
+	}
+	return rules, nil
+}
+
+// repoSettingsMetrics reports the settings of a repo and checks them against the configured rules.
+func (c *BitbucketCollector) repoSettingsMetrics(repo Repository, s repoSettings) []prometheus.Metric {
+	labels := []string{repo.ProjectKey, repo.Slug}
+	for _, name := range repoSettingNames {
+		labels = append(labels, s.values[name])
+	}
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(c.repoInfo, prometheus.GaugeValue, 1, labels...),
+	}
+	for name, desc := range map[string]*prometheus.Desc{"is_private": c.repoIsPrivate, "has_issues": c.repoHasIssues, "has_wiki": c.repoHasWiki} {
+		if v, ok := s.values[name]; ok {
+			metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, boolToFloat(v == "true"), repo.ProjectKey, repo.Slug))
+		}
+	}
+	if !s.createdOn.IsZero() {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.repoCreatedTime, prometheus.GaugeValue, float64(s.createdOn.Unix()), repo.ProjectKey, repo.Slug))
+	}
+	if !s.updatedOn.IsZero() {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.repoUpdatedTime, prometheus.GaugeValue, float64(s.updatedOn.Unix()), repo.ProjectKey, repo.Slug))
+	}
+
+	rules := make([]string, 0, len(c.repoRules))
+	for name := range c.repoRules {
+		rules = append(rules, name)
+	}
+	sort.Strings(rules)
+	for _, name := range rules {
+		got, ok := s.values[name]
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.repoPolicyViolation, prometheus.GaugeValue, boolToFloat(got != c.repoRules[name]), repo.ProjectKey, repo.Slug, name))
+	}
+	return metrics
+}
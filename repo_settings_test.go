@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRepoSettingsMetrics_Violations(t *testing.T) {
+	cfg := &Config{RepoRules: map[string]string{"is_private": "true", "has_wiki": "false", "fork_policy": "no_public_forks"}}
+	c := NewBitbucketCollector(&BitbucketClient{Cloud: true}, cfg, "info", 0)
+	obj := cloudRepoObject{IsPrivate: false, ForkPolicy: "no_public_forks", HasWiki: false}
+
+	out := scrape(t, staticCollector(c.repoSettingsMetrics(Repository{ProjectKey: "PRJ", Slug: "app"}, obj.settings())))
+	for _, want := range []string{
+		`bitbucket_repo_is_private{project_key="PRJ",repo_slug="app"} 0`,
+		`bitbucket_repo_policy_violation{project_key="PRJ",repo_slug="app",rule="is_private"} 1`,
+		`bitbucket_repo_policy_violation{project_key="PRJ",repo_slug="app",rule="has_wiki"} 0`,
+		`bitbucket_repo_policy_violation{project_key="PRJ",repo_slug="app",rule="fork_policy"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q", want)
+		}
+	}
+	if _, err := parseRepoRules("is_public=false"); err == nil {
+		t.Errorf("unknown setting should be rejected")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// codeownersPaths are the locations Bitbucket reads a CODEOWNERS file from, in order.
+var codeownersPaths = []string{"CODEOWNERS", ".bitbucket/CODEOWNERS"}
+
+// DefaultReviewers returns the distinct users added as default reviewers to
+// pull requests of a repository. On Cloud these are the effective reviewers,
+// including those inherited from the project. On Data Center they are the
+// users of all reviewer conditions, members of reviewer groups included.
+func (c *BitbucketClient) DefaultReviewers(repo Repository) (int, error) {
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			User struct {
+				UUID string `json:"uuid"`
+			} `json:"user"`
+		}](c, c.repoPath(repo)+"/effective-default-reviewers?pagelen=100")
+		if err != nil {
+			return 0, err
+		}
+		// A user configured on both the repository and its project is listed twice.
+		reviewers := make(map[string]bool)
+		for _, v := range values {
+			reviewers[v.User.UUID] = true
+		}
+		return len(reviewers), nil
+	}
+	type dcUser struct {
+		ID int `json:"id"`
+	}
+	var conditions []struct {
+		Reviewers      []dcUser `json:"reviewers"`
+		ReviewerGroups []struct {
+			Users []dcUser `json:"users"`
+		} `json:"reviewerGroups"`
+	}
+	u := fmt.Sprintf("%s/rest/default-reviewers/1.0/projects/%s/repos/%s/conditions", c.BaseURL, url.PathEscape(repo.ProjectKey), url.PathEscape(repo.Slug))
+	if err := c.getJSON(u, &conditions); err != nil {
+		return 0, err
+	}
+	reviewers := make(map[int]bool)
+	for _, cond := range conditions {
+		for _, r := range cond.Reviewers {
+			reviewers[r.ID] = true
+		}
+		for _, g := range cond.ReviewerGroups {
+			for _, r := range g.Users {
+				reviewers[r.ID] = true
+			}
+		}
+	}
+	return len(reviewers), nil
+}
+
+// fileExists reports whether a file exists at the given commit of a repository.
+func (c *BitbucketClient) fileExists(repo Repository, commit, path string) (bool, error) {
+	u := c.repoPath(repo) + "/src/" + url.PathEscape(commit) + "/" + path
+	if !c.Cloud {
+		u = c.repoPath(repo) + "/raw/" + path + "?at=" + url.QueryEscape(commit)
+	}
+	return c.exists("HEAD", u)
+}
+
+// reviewerMetrics reports the default reviewers of a repo, whether its
+// default branch, at commit head, has a CODEOWNERS file, and how many of its
+// open pull requests prs have at least one reviewer. The coverage is left out
+// unless prsFetched says prs could be read.
+func (c *BitbucketCollector) reviewerMetrics(repo Repository, head string, prs []PullRequest, prsFetched bool) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	if n, err := c.client.DefaultReviewers(repo); err != nil {
+		debugf(c.logLevel, "Failed to fetch default reviewers for %s: %v", repo.Slug, err)
+	} else {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.defaultReviewersTotal, prometheus.GaugeValue, float64(n), repo.ProjectKey, repo.Slug))
+	}
+
+	if head != "" {
+		present, known := false, true
+		for _, p := range codeownersPaths {
+			ok, err := c.client.fileExists(repo, head, p)
+			if err != nil {
+				debugf(c.logLevel, "Failed to look up %s in %s: %v", p, repo.Slug, err)
+				known = false
+				break
+			}
+			if ok {
+				present = true
+				break
+			}
+		}
+		if known {
+			metrics = append(metrics, prometheus.MustNewConstMetric(c.codeownersPresent, prometheus.GaugeValue, boolToFloat(present), repo.ProjectKey, repo.Slug))
+		}
+	}
+
+	if !prsFetched {
+		return metrics
+	}
+	reviewed := 0
+	for _, pr := range prs {
+		if pr.Reviewers > 0 {
+			reviewed++
+		}
+	}
+	metrics = append(metrics, prometheus.MustNewConstMetric(c.prsWithReviewer, prometheus.GaugeValue, float64(reviewed), repo.ProjectKey, repo.Slug))
+	if len(prs) > 0 {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.prReviewerCoverage, prometheus.GaugeValue, float64(reviewed)/float64(len(prs)), repo.ProjectKey, repo.Slug))
+	}
+	return metrics
+}
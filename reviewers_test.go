@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDefaultReviewers_CloudEffective(t *testing.T) {
+	reviewer := func(uuid, reviewerType string) map[string]interface{} {
+		return map[string]interface{}{"reviewer_type": reviewerType, "user": map[string]string{"uuid": uuid}}
+	}
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2.0/repositories/testws/app/effective-default-reviewers" {
+			w.WriteHeader(404)
+			return
+		}
+		// {2} is configured on both the repository and its project.
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+			reviewer("{1}", "repository"), reviewer("{2}", "repository"), reviewer("{2}", "project"), reviewer("{3}", "project"),
+		}})
+	}))
+
+	n, err := client.DefaultReviewers(Repository{ProjectKey: "PRJ", Slug: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d default reviewers, want 3", n)
+	}
+}
+
+func TestDefaultReviewers_DataCenterGroups(t *testing.T) {
+	user := func(id int) map[string]int { return map[string]int{"id": id} }
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/default-reviewers/1.0/projects/PRJ/repos/app/conditions" {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode([]interface{}{
+			map[string]interface{}{"reviewers": []interface{}{user(1), user(2)}},
+			// A condition with only a reviewer group; user 2 is also a direct reviewer above.
+			map[string]interface{}{"reviewers": []interface{}{}, "reviewerGroups": []interface{}{
+				map[string]interface{}{"name": "backend", "users": []interface{}{user(2), user(3), user(4)}},
+			}},
+		})
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+
+	n, err := client.DefaultReviewers(Repository{ProjectKey: "PRJ", Slug: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("got %d default reviewers, want 4", n)
+	}
+}
+
+func TestReviewerMetrics_Coverage(t *testing.T) {
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	c := NewBitbucketCollector(client, &Config{}, "info", 0)
+	repo := Repository{ProjectKey: "PRJ", Slug: "app"}
+	prs := []PullRequest{{ID: 1, Reviewers: 2}, {ID: 2}, {ID: 3, Reviewers: 1}, {ID: 4}}
+
+	out := scrape(t, staticCollector(c.reviewerMetrics(repo, "", prs, true)))
+	for _, want := range []string{
+		`bitbucket_repo_open_prs_with_reviewer{project_key="PRJ",repo_slug="app"} 2`,
+		`bitbucket_repo_open_prs_reviewer_coverage_ratio{project_key="PRJ",repo_slug="app"} 0.5`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+
+	// No open pull requests: nothing to take a ratio of.
+	out = scrape(t, staticCollector(c.reviewerMetrics(repo, "", nil, true)))
+	if !strings.Contains(out, `bitbucket_repo_open_prs_with_reviewer{project_key="PRJ",repo_slug="app"} 0`) || strings.Contains(out, "coverage_ratio") {
+		t.Errorf("unexpected coverage without open pull requests\n%s", out)
+	}
+
+	// Open pull requests could not be read.
+	out = scrape(t, staticCollector(c.reviewerMetrics(repo, "", nil, false)))
+	if strings.Contains(out, "open_prs") {
+		t.Errorf("coverage reported without open pull requests\n%s", out)
+	}
+}
+
+func TestReviewerMetrics_Codeowners(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status map[string]int // HEAD status by path; 404 otherwise
+		want   string         // expected sample, empty when none
+	}{
+		{"root", map[string]int{"/2.0/repositories/testws/app/src/h1/CODEOWNERS": 200}, "1"},
+		{"bitbucket dir", map[string]int{"/2.0/repositories/testws/app/src/h1/.bitbucket/CODEOWNERS": 200}, "1"},
+		{"absent", nil, "0"},
+		{"unreadable", map[string]int{"/2.0/repositories/testws/app/src/h1/CODEOWNERS": 500}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if s, ok := tc.status[r.URL.Path]; ok && r.Method == "HEAD" {
+					w.WriteHeader(s)
+					return
+				}
+				w.WriteHeader(404)
+			}))
+			c := NewBitbucketCollector(client, &Config{}, "info", 0)
+
+			out := scrape(t, staticCollector(c.reviewerMetrics(Repository{ProjectKey: "PRJ", Slug: "app"}, "h1", nil, false)))
+			sample := `bitbucket_repo_codeowners_present{project_key="PRJ",repo_slug="app"} `
+			if tc.want == "" {
+				if strings.Contains(out, sample) {
+					t.Errorf("CODEOWNERS reported although it could not be looked up\n%s", out)
+				}
+			} else if !strings.Contains(out, sample+tc.want+"\n") {
+				t.Errorf("scrape missing %q\n%s", sample+tc.want, out)
+			}
+		})
+	}
+}
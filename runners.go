@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runnerStates are the states a self-hosted Pipelines runner can report.
+var runnerStates = []string{"ONLINE", "OFFLINE", "UNREGISTERED", "DISABLED"}
+
+// cloudRunner is the subset of a Pipelines runner object the exporter reads.
+type cloudRunner struct {
+	UUID   string   `json:"uuid"`
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+	State  struct {
+		Status    string `json:"status"`
+		UpdatedOn string `json:"updated_on"`
+	} `json:"state"`
+}
+
+// RunnerCollector reports the inventory and health of self-hosted Pipelines
+// runners registered on the workspace and on individual repositories.
+type RunnerCollector struct {
+	client   *BitbucketClient
+	logLevel string
+
+	runnerInfo           *prometheus.Desc
+	runnerStatus         *prometheus.Desc
+	runnerHeartbeatAge   *prometheus.Desc
+	runnersOnlineByLabel *prometheus.Desc
+}
+
+func NewRunnerCollector(client *BitbucketClient, logLevel string) *RunnerCollector {
+	return &RunnerCollector{
+		client:               client,
+		logLevel:             logLevel,
+		runnerInfo:           prometheus.NewDesc("bitbucket_pipeline_runner_info", "Self-hosted Pipelines runner inventory", []string{"uuid", "name", "labels", "repo_slug"}, nil),
+		runnerStatus:         prometheus.NewDesc("bitbucket_pipeline_runner_status", "Current state of each self-hosted runner (1 for the active state)", []string{"uuid", "state"}, nil),
+		runnerHeartbeatAge:   prometheus.NewDesc("bitbucket_pipeline_runner_heartbeat_age_seconds", "Seconds since the runner last reported its state", []string{"uuid"}, nil),
+		runnersOnlineByLabel: prometheus.NewDesc("bitbucket_pipeline_runners_online", "Number of ONLINE self-hosted runners carrying each label", []string{"label"}, nil),
+	}
+}
+
+func (c *RunnerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.runnerInfo
+	ch <- c.runnerStatus
+	ch <- c.runnerHeartbeatAge
+	ch <- c.runnersOnlineByLabel
+}
+
+func (c *RunnerCollector) Collect(ch chan<- prometheus.Metric) {
+	// Runners are a Bitbucket Cloud Pipelines feature.
+	if !c.client.Cloud {
+		return
+	}
+	onlineByLabel := make(map[string]int)
+	emit := func(runners []cloudRunner, repoSlug string) {
+		for _, r := range runners {
+			labels := append([]string(nil), r.Labels...)
+			sort.Strings(labels)
+			ch <- prometheus.MustNewConstMetric(c.runnerInfo, prometheus.GaugeValue, 1, r.UUID, r.Name, strings.Join(labels, ","), repoSlug)
+			for _, state := range runnerStates {
+				ch <- prometheus.MustNewConstMetric(c.runnerStatus, prometheus.GaugeValue, boolToFloat(r.State.Status == state), r.UUID, state)
+			}
+			if t, err := time.Parse(time.RFC3339, r.State.UpdatedOn); err == nil {
+				ch <- prometheus.MustNewConstMetric(c.runnerHeartbeatAge, prometheus.GaugeValue, time.Since(t).Seconds(), r.UUID)
+			}
+			// Every label seen is reported, so capacity dropping to zero is a 0 rather than a missing series.
+			for _, l := range labels {
+				if _, ok := onlineByLabel[l]; !ok {
+					onlineByLabel[l] = 0
+				}
+				if r.State.Status == "ONLINE" {
+					onlineByLabel[l]++
+				}
+			}
+		}
+	}
+
+	runners, err := cloudPages[cloudRunner](c.client, fmt.Sprintf("%s/workspaces/%s/pipelines-config/runners?pagelen=100", cloudAPIURL, c.client.Workspace))
+	if err != nil {
+		log.Printf("error collecting workspace runners: %v", err)
+	} else {
+		emit(runners, "")
+	}
+
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		log.Printf("error listing repositories for runners: %v", err)
+	}
+	for _, repo := range repos {
+		runners, err := cloudPages[cloudRunner](c.client, fmt.Sprintf("%s/repositories/%s/%s/pipelines-config/runners?pagelen=100", cloudAPIURL, c.client.Workspace, repo.Slug))
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch runners for %s: %v", repo.Slug, err)
+			continue
+		}
+		emit(runners, repo.Slug)
+	}
+
+	for label, n := range onlineByLabel {
+		ch <- prometheus.MustNewConstMetric(c.runnersOnlineByLabel, prometheus.GaugeValue, float64(n), label)
+	}
+}
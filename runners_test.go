@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunnerCollector_StatusHeartbeatAndLabels(t *testing.T) {
+	runner := func(uuid, status string, updated time.Time, labels ...string) map[string]interface{} {
+		return map[string]interface{}{
+			"uuid": uuid, "name": uuid, "labels": labels,
+			"state": map[string]interface{}{"status": status, "updated_on": updated.UTC().Format(time.RFC3339)},
+		}
+	}
+	now := time.Now()
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2.0/workspaces/testws/pipelines-config/runners":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				runner("r1", "ONLINE", now.Add(-2*time.Minute), "self.hosted", "linux"),
+				runner("r2", "OFFLINE", now.Add(-time.Hour), "self.hosted", "windows"),
+			}})
+		case "/2.0/repositories/testws":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				map[string]interface{}{"slug": "app", "name": "App", "project": map[string]interface{}{"key": "PRJ"}},
+			}})
+		case "/2.0/repositories/testws/app/pipelines-config/runners":
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": []interface{}{
+				runner("r3", "ONLINE", now, "linux", "self.hosted"),
+			}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+
+	out := scrape(t, NewRunnerCollector(client, "info"))
+	for _, want := range []string{
+		`bitbucket_pipeline_runner_info{labels="linux,self.hosted",name="r1",repo_slug="",uuid="r1"} 1`,
+		`bitbucket_pipeline_runner_info{labels="linux,self.hosted",name="r3",repo_slug="app",uuid="r3"} 1`,
+		`bitbucket_pipeline_runner_status{state="ONLINE",uuid="r1"} 1`,
+		`bitbucket_pipeline_runner_status{state="OFFLINE",uuid="r1"} 0`,
+		`bitbucket_pipeline_runner_status{state="OFFLINE",uuid="r2"} 1`,
+		`bitbucket_pipeline_runners_online{label="linux"} 2`,
+		`bitbucket_pipeline_runners_online{label="self.hosted"} 2`,
+		`bitbucket_pipeline_runners_online{label="windows"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	// Heartbeats are sent with second precision and the scrape takes a moment.
+	for series, want := range map[string]float64{
+		`bitbucket_pipeline_runner_heartbeat_age_seconds{uuid="r1"}`: 120,
+		`bitbucket_pipeline_runner_heartbeat_age_seconds{uuid="r2"}`: 3600,
+	} {
+		if got := sampleValue(t, out, series); got < want || got > want+5 {
+			t.Errorf("%s = %v, want %v to %v", series, got, want, want+5)
+		}
+	}
+}
+
+// sampleValue returns the value of a series in a text exposition.
+func sampleValue(t *testing.T, out, series string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(out, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", series, err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("scrape missing %s\n%s", series, out)
+	return 0
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sizeSampleInterval is the minimum spacing of stored samples per repository.
+// Refreshes, webhook-triggered ones included, can run far more often.
+const sizeSampleInterval = time.Hour
+
+// sizeWindowCoverage is the fraction of a growth window the oldest sample in
+// it must cover before the window is reported, so a few minutes of history are
+// not extrapolated to a month.
+const sizeWindowCoverage = 0.5
+
+// sizeSample is one observation of a repository's size.
+type sizeSample struct {
+	At    time.Time `json:"at"`
+	Bytes int64     `json:"bytes"`
+}
+
+// sizeHistory keeps the size samples of every repository for as long as the
+// longest growth window, optionally persisted to a file across restarts.
+type sizeHistory struct {
+	file    string
+	windows []int // days
+
+	mu      sync.Mutex
+	samples map[string][]sizeSample // project/slug -> samples, oldest first
+}
+
+func newSizeHistory(file string, windows []int) *sizeHistory {
+	h := &sizeHistory{file: file, windows: windows, samples: make(map[string][]sizeSample)}
+	if file == "" {
+		return h
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return h
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &h.samples)
+	}
+	if err != nil {
+		log.Printf("error reading size history %s, starting empty: %v", file, err)
+	}
+	return h
+}
+
+// retention is how long samples are kept: the longest growth window.
+func (h *sizeHistory) retention() time.Duration {
+	longest := 0
+	for _, w := range h.windows {
+		if w > longest {
+			longest = w
+		}
+	}
+	return time.Duration(longest) * 24 * time.Hour
+}
+
+// record adds a sample, unless the newest stored one is less than
+// sizeSampleInterval old, and returns the growth in bytes per day over each
+// window, measured from the oldest sample inside it. Windows whose oldest
+// sample covers less than sizeWindowCoverage of them are left out.
+func (h *sizeHistory) record(key string, s sizeSample) map[int]float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cutoff := s.At.Add(-h.retention())
+	var kept []sizeSample
+	for _, old := range h.samples[key] {
+		if !old.At.Before(cutoff) && old.At.Before(s.At) {
+			kept = append(kept, old)
+		}
+	}
+	h.samples[key] = kept
+	if len(kept) == 0 || s.At.Sub(kept[len(kept)-1].At) >= sizeSampleInterval {
+		h.samples[key] = append(kept, s)
+	}
+
+	growth := make(map[int]float64)
+	for _, w := range h.windows {
+		window := time.Duration(w) * 24 * time.Hour
+		start := s.At.Add(-window)
+		for _, old := range kept {
+			if !old.At.Before(start) {
+				if span := s.At.Sub(old.At); span >= time.Duration(float64(window)*sizeWindowCoverage) {
+					growth[w] = float64(s.Bytes-old.Bytes) / span.Hours() * 24
+				}
+				break
+			}
+		}
+	}
+	return growth
+}
+
+// save persists the history and drops repositories without recent samples.
+func (h *sizeHistory) save() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cutoff := time.Now().Add(-h.retention())
+	for key, samples := range h.samples {
+		if len(samples) == 0 || samples[len(samples)-1].At.Before(cutoff) {
+			delete(h.samples, key)
+		}
+	}
+	if h.file == "" {
+		return
+	}
+	data, _ := json.Marshal(h.samples)
+	tmp := h.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("error writing size history: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, h.file); err != nil {
+		log.Printf("error writing size history: %v", err)
+	}
+}
+
+// serverRepoSize reads the size of a Data Center repository from the sizes endpoint.
+func (c *BitbucketClient) serverRepoSize(repo Repository) (int64, error) {
+	var sizes struct {
+		Repository int64 `json:"repository"`
+	}
+	u := fmt.Sprintf("%s/projects/%s/repos/%s/sizes", c.BaseURL, url.PathEscape(repo.ProjectKey), url.PathEscape(repo.Slug))
+	if err := c.getJSON(u, &sizes); err != nil {
+		return 0, err
+	}
+	return sizes.Repository, nil
+}
+
+// serverLFSEnabled reports whether Git LFS is enabled on a Data Center repository.
+func (c *BitbucketClient) serverLFSEnabled(repo Repository) (bool, error) {
+	u := fmt.Sprintf("%s/rest/git-lfs/admin/projects/%s/repos/%s/enabled", c.BaseURL, url.PathEscape(repo.ProjectKey), url.PathEscape(repo.Slug))
+	return c.exists("GET", u)
+}
+
+// sizeMetrics reports the size of a repo, records it in the size history
+// and reports its growth over each configured window.
+func (c *BitbucketCollector) sizeMetrics(repo Repository, bytes int64) []prometheus.Metric {
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(c.perRepoSize, prometheus.GaugeValue, float64(bytes), repo.ProjectKey, repo.ProjectName, repo.Slug, repo.Name),
+	}
+	growth := c.sizeHistory.record(repo.ProjectKey+"/"+repo.Slug, sizeSample{time.Now(), bytes})
+	for _, w := range c.sizeHistory.windows {
+		if rate, ok := growth[w]; ok {
+			metrics = append(metrics, prometheus.MustNewConstMetric(c.repoSizeGrowth, prometheus.GaugeValue, rate, repo.ProjectKey, repo.Slug, fmt.Sprintf("%dd", w)))
+		}
+	}
+	return metrics
+}
+
+// serverSizeMetrics reports the size and LFS status of a Data Center repo.
+func (c *BitbucketCollector) serverSizeMetrics(repo Repository) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	if bytes, err := c.client.serverRepoSize(repo); err != nil {
+		debugf(c.logLevel, "Failed to fetch size of %s: %v", repo.Slug, err)
+	} else {
+		metrics = c.sizeMetrics(repo, bytes)
+	}
+	if enabled, err := c.client.serverLFSEnabled(repo); err != nil {
+		debugf(c.logLevel, "Failed to fetch LFS status of %s: %v", repo.Slug, err)
+	} else {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.repoLFSEnabled, prometheus.GaugeValue, boolToFloat(enabled), repo.ProjectKey, repo.Slug))
+	}
+	return metrics
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSizeHistory_GrowthPerWindow(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sizes.json")
+	h := newSizeHistory(file, []int{7, 30})
+	now := time.Now().UTC()
+
+	if got := h.record("PRJ/app", sizeSample{now.AddDate(0, 0, -40), 0}); len(got) != 0 {
+		t.Errorf("first sample: want no growth, got %v", got)
+	}
+	h.record("PRJ/app", sizeSample{now.AddDate(0, 0, -20), 1000})
+	h.record("PRJ/app", sizeSample{now.AddDate(0, 0, -5), 4000})
+	got := h.record("PRJ/app", sizeSample{now, 5000})
+
+	// The sample from 40 days ago is outside both windows and dropped.
+	if got[30] != 200 {
+		t.Errorf("30d growth: want 200 bytes/day, got %v", got[30])
+	}
+	if got[7] != 200 {
+		t.Errorf("7d growth: want 200 bytes/day, got %v", got[7])
+	}
+	if n := len(h.samples["PRJ/app"]); n != 3 {
+		t.Errorf("want 3 retained samples, got %d", n)
+	}
+
+	h.save()
+	reloaded := newSizeHistory(file, []int{7, 30})
+	if n := len(reloaded.samples["PRJ/app"]); n != 3 {
+		t.Errorf("want 3 samples after reload, got %d", n)
+	}
+}
+
+func TestSizeHistory_DownsamplesAndNeedsCoverage(t *testing.T) {
+	h := newSizeHistory("", []int{7})
+	now := time.Now().UTC()
+
+	h.record("PRJ/app", sizeSample{now.Add(-3 * 24 * time.Hour), 1000})
+	// Webhook refreshes minutes apart are not stored.
+	for i := 0; i < 10; i++ {
+		h.record("PRJ/app", sizeSample{now.Add(-2*24*time.Hour + time.Duration(i)*time.Minute), 1500})
+	}
+	if n := len(h.samples["PRJ/app"]); n != 2 {
+		t.Errorf("want 2 retained samples, got %d", n)
+	}
+	// Three days of history do not cover half of the 7 day window.
+	if got := h.record("PRJ/app", sizeSample{now, 2000}); len(got) != 0 {
+		t.Errorf("want no 7d growth from 3 days of samples, got %v", got)
+	}
+
+	h.record("PRJ/lib", sizeSample{now.Add(-4 * 24 * time.Hour), 0})
+	if got := h.record("PRJ/lib", sizeSample{now, 2000}); got[7] != 500 {
+		t.Errorf("7d growth over 4 days: want 500 bytes/day, got %v", got)
+	}
+}
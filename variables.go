@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultSecretVariablePatterns are the variable names that look like secrets
+// when BITBUCKET_SECRET_VARIABLE_PATTERNS is unset.
+var defaultSecretVariablePatterns = []string{"*_TOKEN", "*_PASSWORD", "*_KEY", "*_SECRET"}
+
+// pipelineVariable is the metadata of a Pipelines variable. The value is
+// deliberately not decoded: it must never be stored or exported.
+type pipelineVariable struct {
+	Key     string `json:"key"`
+	Secured bool   `json:"secured"`
+}
+
+// VariableCollector reports the hygiene of Bitbucket Cloud Pipelines
+// variables on the workspace, repositories and deployment environments.
+type VariableCollector struct {
+	client   *BitbucketClient
+	logLevel string
+	patterns []string // upper-case glob patterns of secret-looking names
+
+	variablesTotal   *prometheus.Desc
+	unsecuredSecrets *prometheus.Desc
+}
+
+func NewVariableCollector(client *BitbucketClient, patterns []string, logLevel string) *VariableCollector {
+	if len(patterns) == 0 {
+		patterns = defaultSecretVariablePatterns
+	}
+	c := &VariableCollector{
+		client:           client,
+		logLevel:         logLevel,
+		variablesTotal:   prometheus.NewDesc("bitbucket_pipeline_variables_total", "Number of Pipelines variables by scope and whether they are secured", []string{"scope", "secured"}, nil),
+		unsecuredSecrets: prometheus.NewDesc("bitbucket_pipeline_variable_unsecured_secret", "Unsecured Pipelines variable whose name looks like a secret", []string{"scope", "repo_slug", "environment", "variable"}, nil),
+	}
+	for _, p := range patterns {
+		c.patterns = append(c.patterns, strings.ToUpper(p))
+	}
+	return c
+}
+
+func (c *VariableCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.variablesTotal
+	ch <- c.unsecuredSecrets
+}
+
+func (c *VariableCollector) Collect(ch chan<- prometheus.Metric) {
+	// Pipelines variables are a Bitbucket Cloud feature.
+	if !c.client.Cloud {
+		return
+	}
+	// Every scope and secured value starts at 0, so the last unsecured variable
+	// going away is a 0 rather than a missing series.
+	counts := map[[2]string]int{}
+	failed := map[string]bool{} // scopes with a fetch error, whose zeros are not known to be true
+	for _, scope := range []string{"workspace", "repository", "deployment"} {
+		for _, secured := range []bool{true, false} {
+			counts[[2]string{scope, boolToString(secured)}] = 0
+		}
+	}
+	check := func(scope, repoSlug, environment string, vars []pipelineVariable) {
+		for _, v := range vars {
+			counts[[2]string{scope, boolToString(v.Secured)}]++
+			if !v.Secured && c.looksSecret(v.Key) {
+				ch <- prometheus.MustNewConstMetric(c.unsecuredSecrets, prometheus.GaugeValue, 1, scope, repoSlug, environment, v.Key)
+			}
+		}
+	}
+
+	vars, err := cloudPages[pipelineVariable](c.client, cloudAPIURL+"/workspaces/"+c.client.Workspace+"/pipelines-config/variables?pagelen=100")
+	if err != nil {
+		debugf(c.logLevel, "Failed to fetch workspace variables: %v", err)
+		failed["workspace"] = true
+	}
+	check("workspace", "", "", vars)
+
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		log.Printf("error listing repositories for pipeline variables: %v", err)
+		failed["repository"], failed["deployment"] = true, true
+	}
+	for _, repo := range repos {
+		base := c.client.repoPath(repo)
+		vars, err := cloudPages[pipelineVariable](c.client, base+"/pipelines_config/variables?pagelen=100")
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch variables for %s: %v", repo.Slug, err)
+			failed["repository"] = true
+		}
+		check("repository", repo.Slug, "", vars)
+
+		envs, err := cloudPages[cloudEnvironment](c.client, base+"/environments/?pagelen=100")
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch environments for %s: %v", repo.Slug, err)
+			failed["deployment"] = true
+			continue
+		}
+		for _, env := range envs {
+			vars, err := cloudPages[pipelineVariable](c.client, base+"/deployments_config/environments/"+url.PathEscape(env.UUID)+"/variables?pagelen=100")
+			if err != nil {
+				debugf(c.logLevel, "Failed to fetch variables of environment %s in %s: %v", env.Name, repo.Slug, err)
+				failed["deployment"] = true
+				continue
+			}
+			check("deployment", repo.Slug, env.Name, vars)
+		}
+	}
+
+	for k, n := range counts {
+		if n == 0 && failed[k[0]] {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.variablesTotal, prometheus.GaugeValue, float64(n), k[0], k[1])
+	}
+}
+
+// looksSecret reports whether a variable name matches one of the secret patterns.
+func (c *VariableCollector) looksSecret(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, p := range c.patterns {
+		if ok, _ := path.Match(p, upper); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVariableCollector_NeverExportsValues(t *testing.T) {
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values []interface{}
+		switch r.URL.Path {
+		case "/2.0/workspaces/testws/pipelines-config/variables":
+			values = []interface{}{map[string]interface{}{"key": "NPM_TOKEN", "secured": true}}
+		case "/2.0/repositories/testws":
+			values = []interface{}{map[string]interface{}{"slug": "app", "project": map[string]string{"key": "PRJ"}}}
+		case "/2.0/repositories/testws/app/pipelines_config/variables":
+			values = []interface{}{
+				map[string]interface{}{"key": "deploy_password", "secured": false, "value": "hunter2"},
+				map[string]interface{}{"key": "REGION", "secured": false, "value": "eu-west-1"},
+			}
+		case "/2.0/repositories/testws/app/environments/":
+			values = []interface{}{map[string]interface{}{"uuid": "{env}", "name": "Production"}}
+		case "/2.0/repositories/testws/app/deployments_config/environments/{env}/variables":
+			values = []interface{}{map[string]interface{}{"key": "AWS_SECRET_ACCESS_KEY", "secured": false, "value": "abc"}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": values})
+	}))
+
+	out := scrape(t, NewVariableCollector(client, nil, "info"))
+	for _, want := range []string{
+		`bitbucket_pipeline_variables_total{scope="workspace",secured="true"} 1`,
+		`bitbucket_pipeline_variables_total{scope="repository",secured="false"} 2`,
+		`bitbucket_pipeline_variables_total{scope="deployment",secured="false"} 1`,
+		`bitbucket_pipeline_variable_unsecured_secret{environment="",repo_slug="app",scope="repository",variable="deploy_password"} 1`,
+		`bitbucket_pipeline_variable_unsecured_secret{environment="Production",repo_slug="app",scope="deployment",variable="AWS_SECRET_ACCESS_KEY"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	for _, value := range []string{"hunter2", "eu-west-1"} {
+		if strings.Contains(out, value) {
+			t.Errorf("variable value %q was exported", value)
+		}
+	}
+}
+
+func TestVariableCollector_FailedScopeNotReportedAsZero(t *testing.T) {
+	client := newCloudTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values []interface{}
+		switch r.URL.Path {
+		case "/2.0/workspaces/testws/pipelines-config/variables":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case "/2.0/repositories/testws":
+			values = []interface{}{map[string]interface{}{"slug": "app", "project": map[string]string{"key": "PRJ"}}}
+		case "/2.0/repositories/testws/app/pipelines_config/variables":
+			values = []interface{}{map[string]interface{}{"key": "REGION", "secured": false}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": values})
+	}))
+
+	out := scrape(t, NewVariableCollector(client, nil, "info"))
+	for _, want := range []string{
+		`bitbucket_pipeline_variables_total{scope="repository",secured="false"} 1`,
+		`bitbucket_pipeline_variables_total{scope="repository",secured="true"} 0`,
+		`bitbucket_pipeline_variables_total{scope="deployment",secured="true"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `scope="workspace"`) {
+		t.Errorf("unreadable workspace variables reported as zero\n%s", out)
+	}
+}
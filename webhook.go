@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxWebhookBody bounds the payload size accepted from Bitbucket.
+const maxWebhookBody = 10 << 20
+
+// webhookRepository is the repository object of a Cloud or Data Center event.
+type webhookRepository struct {
+	Slug     string `json:"slug"`
+	FullName string `json:"full_name"`
+	Project  struct {
+		Key string `json:"key"`
+	} `json:"project"`
+}
+
+// webhookPayload covers the fields the receiver reads from Cloud and Data Center
+// push and pull request events. Cloud nests push changes under "push"; Data
+// Center puts them at the top level. Data Center pull request events carry no
+// top-level repository, only the pull request's target ref.
+type webhookPayload struct {
+	Repository  webhookRepository `json:"repository"`
+	PullRequest struct {
+		ToRef struct {
+			Repository webhookRepository `json:"repository"`
+		} `json:"toRef"`
+	} `json:"pullRequest"`
+	Push struct {
+		Changes []struct {
+			Forced  bool              `json:"forced"`
+			Commits []json.RawMessage `json:"commits"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// repo returns the project key and slug of the repository the event belongs to.
+func (p webhookPayload) repo() Repository {
+	r := p.Repository
+	if r.Slug == "" && r.FullName == "" {
+		r = p.PullRequest.ToRef.Repository
+	}
+	slug := r.Slug
+	if slug == "" {
+		// Cloud only sends "workspace/slug".
+		slug = r.FullName[strings.LastIndex(r.FullName, "/")+1:]
+	}
+	return Repository{ProjectKey: r.Project.Key, Slug: slug}
+}
+
+// pullRequestActions maps Cloud and Data Center pull request event keys to a common action.
+var pullRequestActions = map[string]string{
+	"pullrequest:created":   "created",
+	"pullrequest:fulfilled": "merged",
+	"pullrequest:rejected":  "declined",
+	"pullrequest:updated":   "updated",
+	"pr:opened":             "created",
+	"pr:merged":             "merged",
+	"pr:declined":           "declined",
+	"pr:deleted":            "deleted",
+	"pr:from_ref_updated":   "updated",
+}
+
+// eventLabel returns the event key if the receiver handles it, otherwise
+// "other". Unsigned deliveries are accepted when no secret is configured, so
+// the raw header would let any caller create label values.
+func eventLabel(event string) string {
+	switch event {
+	case "diagnostics:ping", "repo:push", "repo:refs_changed":
+		return event
+	}
+	if _, ok := pullRequestActions[event]; ok {
+		return event
+	}
+	return "other"
+}
+
+// WebhookReceiver accepts Bitbucket webhook deliveries on /webhook and turns
+// them into event counters that are exact rather than sampled at scrape time.
+type WebhookReceiver struct {
+	secret      []byte
+	logLevel    string
+	onRepoEvent func(projectKey, slug string)
+
+	eventsTotal            *prometheus.CounterVec
+	invalidSignaturesTotal prometheus.Counter
+	pushesTotal            *prometheus.CounterVec
+	commitsPushedTotal     *prometheus.CounterVec
+	forcePushesTotal       *prometheus.CounterVec
+	pullRequestEventsTotal *prometheus.CounterVec
+	prMergedTotal          prometheus.Counter
+}
+
+// NewWebhookReceiver creates the receiver. onRepoEvent, if not nil, is called
+// for every push or pull request event with the repository it concerns.
+func NewWebhookReceiver(secret string, logLevel string, onRepoEvent func(projectKey, slug string)) *WebhookReceiver {
+	repoLabels := []string{"project_key", "repo_slug"}
+	return &WebhookReceiver{
+		secret:      []byte(secret),
+		logLevel:    logLevel,
+		onRepoEvent: onRepoEvent,
+		eventsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_webhook_events_total",
+			Help: "Number of webhook deliveries received by event key; keys the receiver does not handle are counted as other",
+		}, []string{"event"}),
+		invalidSignaturesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bitbucket_webhook_invalid_signatures_total",
+			Help: "Number of webhook deliveries rejected because of a missing or invalid signature",
+		}),
+		pushesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_pushes_total",
+			Help: "Number of pushes received via webhook",
+		}, repoLabels),
+		commitsPushedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_commits_pushed_total",
+			Help: "Number of commits pushed, as listed in Cloud push events; a lower bound, as Cloud lists at most 5 commits per ref change",
+		}, repoLabels),
+		forcePushesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_force_pushes_total",
+			Help: "Number of ref changes that rewrote history (Cloud only)",
+		}, repoLabels),
+		pullRequestEventsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bitbucket_pull_request_events_total",
+			Help: "Number of pull request lifecycle events by action",
+		}, append(repoLabels, "action")),
+		prMergedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bitbucket_pull_requests_merged_total",
+			Help: "Cumulative number of merged pull requests",
+		}),
+	}
+}
+
+func (r *WebhookReceiver) Describe(ch chan<- *prometheus.Desc) {
+	r.eventsTotal.Describe(ch)
+	r.invalidSignaturesTotal.Describe(ch)
+	r.pushesTotal.Describe(ch)
+	r.commitsPushedTotal.Describe(ch)
+	r.forcePushesTotal.Describe(ch)
+	r.pullRequestEventsTotal.Describe(ch)
+	r.prMergedTotal.Describe(ch)
+}
+
+func (r *WebhookReceiver) Collect(ch chan<- prometheus.Metric) {
+	r.eventsTotal.Collect(ch)
+	r.invalidSignaturesTotal.Collect(ch)
+	r.pushesTotal.Collect(ch)
+	r.commitsPushedTotal.Collect(ch)
+	r.forcePushesTotal.Collect(ch)
+	r.pullRequestEventsTotal.Collect(ch)
+	r.prMergedTotal.Collect(ch)
+}
+
+// validSignature checks the "sha256=<hex>" HMAC Bitbucket sends in X-Hub-Signature.
+// Deliveries are accepted unsigned only when no secret is configured.
+func (r *WebhookReceiver) validSignature(header string, body []byte) bool {
+	if len(r.secret) == 0 {
+		return true
+	}
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func (r *WebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookBody))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !r.validSignature(req.Header.Get("X-Hub-Signature"), body) {
+		r.invalidSignaturesTotal.Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	event := req.Header.Get("X-Event-Key")
+	r.eventsTotal.WithLabelValues(eventLabel(event)).Inc()
+	if event == "diagnostics:ping" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Printf("Failed to unmarshal webhook payload for %s: %v", event, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	repo := payload.repo()
+	debugf(r.logLevel, "Webhook %s for %s/%s", event, repo.ProjectKey, repo.Slug)
+
+	switch event {
+	case "repo:push":
+		r.pushesTotal.WithLabelValues(repo.ProjectKey, repo.Slug).Inc()
+		for _, change := range payload.Push.Changes {
+			r.commitsPushedTotal.WithLabelValues(repo.ProjectKey, repo.Slug).Add(float64(len(change.Commits)))
+			if change.Forced {
+				r.forcePushesTotal.WithLabelValues(repo.ProjectKey, repo.Slug).Inc()
+			}
+		}
+	case "repo:refs_changed":
+		r.pushesTotal.WithLabelValues(repo.ProjectKey, repo.Slug).Inc()
+	default:
+		action, ok := pullRequestActions[event]
+		if !ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		r.pullRequestEventsTotal.WithLabelValues(repo.ProjectKey, repo.Slug, action).Inc()
+		if action == "merged" {
+			r.prMergedTotal.Inc()
+		}
+	}
+	if r.onRepoEvent != nil {
+		r.onRepoEvent(repo.ProjectKey, repo.Slug)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// webhookDeliveryBuckets cover fast receivers up to Bitbucket's delivery timeout.
+var webhookDeliveryBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}
+
+// webhookConfig is a configured webhook normalised across Cloud and Data Center.
+type webhookConfig struct {
+	ID                   string
+	URL                  string
+	Events               []string
+	Active               bool
+	SkipCertVerification bool
+}
+
+// webhookScope is one place webhooks can be configured: the Cloud workspace,
+// a Data Center project, or a repository on either flavor.
+type webhookScope struct {
+	name       string // workspace, project or repository
+	projectKey string
+	repoSlug   string
+	base       string // REST root the webhooks live under
+}
+
+// dcWebhookInvocation is a single Data Center webhook delivery.
+type dcWebhookInvocation struct {
+	Event    string `json:"event"`
+	Duration int64  `json:"duration"` // milliseconds
+	Finish   int64  `json:"finish"`   // epoch milliseconds
+	Result   struct {
+		Outcome string `json:"outcome"`
+	} `json:"result"`
+}
+
+// listWebhooks returns the webhooks configured on a scope.
+func (c *BitbucketClient) listWebhooks(scope webhookScope) ([]webhookConfig, error) {
+	var hooks []webhookConfig
+	if c.Cloud {
+		values, err := cloudPages[struct {
+			UUID                 string   `json:"uuid"`
+			URL                  string   `json:"url"`
+			Events               []string `json:"events"`
+			Active               bool     `json:"active"`
+			SkipCertVerification bool     `json:"skip_cert_verification"`
+		}](c, scope.base+"/hooks?pagelen=100")
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			hooks = append(hooks, webhookConfig{v.UUID, v.URL, v.Events, v.Active, v.SkipCertVerification})
+		}
+		return hooks, nil
+	}
+	values, err := serverPages[struct {
+		ID                      int      `json:"id"`
+		URL                     string   `json:"url"`
+		Events                  []string `json:"events"`
+		Active                  bool     `json:"active"`
+		SSLVerificationRequired *bool    `json:"sslVerificationRequired"`
+	}](c, scope.base+"/webhooks?limit=100")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		skip := v.SSLVerificationRequired != nil && !*v.SSLVerificationRequired
+		hooks = append(hooks, webhookConfig{fmt.Sprint(v.ID), v.URL, v.Events, v.Active, skip})
+	}
+	return hooks, nil
+}
+
+// WebhookInventoryCollector reports every configured webhook and, on Data
+// Center, the delivery statistics Bitbucket keeps for it.
+type WebhookInventoryCollector struct {
+	client   *BitbucketClient
+	logLevel string
+
+	mu           sync.Mutex
+	lastObserved map[string]int64 // scope base + webhook id -> finish of the last sampled delivery
+
+	webhooksTotal           *prometheus.Desc
+	webhookInfo             *prometheus.Desc
+	windowDeliveries        *prometheus.Desc
+	windowFailures          *prometheus.Desc
+	lastSuccessTime         *prometheus.Desc
+	deliveryDurationSeconds *prometheus.HistogramVec
+}
+
+func NewWebhookInventoryCollector(client *BitbucketClient, logLevel string) *WebhookInventoryCollector {
+	scopeLabels := []string{"scope", "project_key", "repo_slug"}
+	return &WebhookInventoryCollector{
+		client:           client,
+		logLevel:         logLevel,
+		lastObserved:     make(map[string]int64),
+		webhooksTotal:    prometheus.NewDesc("bitbucket_webhooks_total", "Total number of webhooks configured", append(scopeLabels, "status"), nil),
+		webhookInfo:      prometheus.NewDesc("bitbucket_webhook_info", "Configured webhook", append(scopeLabels, "webhook_id", "url_host", "events", "active", "skip_cert_verification"), nil),
+		windowDeliveries: prometheus.NewDesc("bitbucket_webhook_window_deliveries", "Webhook deliveries by outcome within Bitbucket's rolling statistics window (Data Center)", append(scopeLabels, "webhook_id", "outcome"), nil),
+		windowFailures:   prometheus.NewDesc("bitbucket_webhook_window_failures", "Webhook failures and errors within Bitbucket's rolling statistics window (Data Center)", append(scopeLabels, "webhook_id", "endpoint"), nil),
+		lastSuccessTime:  prometheus.NewDesc("bitbucket_webhook_last_success_timestamp", "Unix timestamp of the last successful delivery (Data Center)", append(scopeLabels, "webhook_id"), nil),
+		deliveryDurationSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bitbucket_webhook_delivery_duration_seconds",
+			Help:    "Duration of webhook delivery, sampled from the latest invocation each scrape (Data Center)",
+			Buckets: webhookDeliveryBuckets,
+		}, append(scopeLabels, "event_type")),
+	}
+}
+
+func (c *WebhookInventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.webhooksTotal
+	ch <- c.webhookInfo
+	ch <- c.windowDeliveries
+	ch <- c.windowFailures
+	ch <- c.lastSuccessTime
+	c.deliveryDurationSeconds.Describe(ch)
+}
+
+func (c *WebhookInventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, scope := range c.scopes() {
+		hooks, err := c.client.listWebhooks(scope)
+		if err != nil {
+			debugf(c.logLevel, "Failed to fetch webhooks for %s %s/%s: %v", scope.name, scope.projectKey, scope.repoSlug, err)
+			continue
+		}
+		active := 0
+		for _, h := range hooks {
+			if h.Active {
+				active++
+			}
+			events := append([]string(nil), h.Events...)
+			sort.Strings(events)
+			host := h.URL
+			if u, err := url.Parse(h.URL); err == nil {
+				host = u.Host
+			}
+			ch <- prometheus.MustNewConstMetric(c.webhookInfo, prometheus.GaugeValue, 1, scope.name, scope.projectKey, scope.repoSlug,
+				h.ID, host, strings.Join(events, ","), boolToString(h.Active), boolToString(h.SkipCertVerification))
+			if !c.client.Cloud {
+				c.collectDeliveries(ch, scope, h, host)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.webhooksTotal, prometheus.GaugeValue, float64(active), scope.name, scope.projectKey, scope.repoSlug, "active")
+		ch <- prometheus.MustNewConstMetric(c.webhooksTotal, prometheus.GaugeValue, float64(len(hooks)-active), scope.name, scope.projectKey, scope.repoSlug, "inactive")
+	}
+	c.deliveryDurationSeconds.Collect(ch)
+}
+
+// scopes lists every place webhooks can be configured: the workspace on Cloud,
+// every project on Data Center, and every repository on both.
+func (c *WebhookInventoryCollector) scopes() []webhookScope {
+	var scopes []webhookScope
+	if c.client.Cloud {
+		scopes = append(scopes, webhookScope{"workspace", "", "", cloudAPIURL + "/workspaces/" + c.client.Workspace})
+	} else {
+		keys, err := c.client.ListProjectKeys()
+		if err != nil {
+			log.Printf("error listing projects for webhooks: %v", err)
+		}
+		for _, key := range keys {
+			scopes = append(scopes, webhookScope{"project", key, "", c.client.BaseURL + "/rest/api/1.0/projects/" + key})
+		}
+	}
+	repos, err := c.client.ListRepositories()
+	if err != nil {
+		log.Printf("error listing repositories for webhooks: %v", err)
+	}
+	for _, repo := range repos {
+		scopes = append(scopes, webhookScope{"repository", repo.ProjectKey, repo.Slug, c.client.repoPath(repo)})
+	}
+	return scopes
+}
+
+// collectDeliveries reads the Data Center statistics and last invocation of a
+// webhook. Bitbucket counts deliveries over a rolling window, so the counts go
+// down as old deliveries age out and are reported as gauges.
+func (c *WebhookInventoryCollector) collectDeliveries(ch chan<- prometheus.Metric, scope webhookScope, h webhookConfig, host string) {
+	hookURL := scope.base + "/webhooks/" + h.ID
+	var stats struct {
+		Counts struct {
+			Successes int `json:"successes"`
+			Failures  int `json:"failures"`
+			Errors    int `json:"errors"`
+		} `json:"counts"`
+		LastSuccess *dcWebhookInvocation `json:"lastSuccess"`
+	}
+	if err := c.client.getJSON(hookURL+"/statistics", &stats); err != nil {
+		debugf(c.logLevel, "Failed to fetch statistics of webhook %s: %v", hookURL, err)
+		return
+	}
+	labels := []string{scope.name, scope.projectKey, scope.repoSlug, h.ID}
+	for outcome, n := range map[string]int{"success": stats.Counts.Successes, "failure": stats.Counts.Failures, "error": stats.Counts.Errors} {
+		ch <- prometheus.MustNewConstMetric(c.windowDeliveries, prometheus.GaugeValue, float64(n), append(labels, outcome)...)
+	}
+	ch <- prometheus.MustNewConstMetric(c.windowFailures, prometheus.GaugeValue, float64(stats.Counts.Failures+stats.Counts.Errors), append(labels, host)...)
+	if stats.LastSuccess != nil {
+		ch <- prometheus.MustNewConstMetric(c.lastSuccessTime, prometheus.GaugeValue, float64(time.UnixMilli(stats.LastSuccess.Finish).Unix()), labels...)
+	}
+
+	var latest dcWebhookInvocation
+	if err := c.client.getJSON(hookURL+"/latest", &latest); err != nil {
+		debugf(c.logLevel, "Failed to fetch last invocation of webhook %s: %v", hookURL, err)
+		return
+	}
+	if latest.Finish > c.lastObserved[hookURL] {
+		c.lastObserved[hookURL] = latest.Finish
+		c.deliveryDurationSeconds.WithLabelValues(scope.name, scope.projectKey, scope.repoSlug, latest.Event).Observe(float64(latest.Duration) / 1000)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookInventoryCollector_DataCenter(t *testing.T) {
+	successes := 40
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects":
+			body = page(map[string]string{"key": "PRJ"})
+		case "/rest/api/1.0/repos":
+			body = page(map[string]interface{}{"id": 1, "slug": "app", "name": "app", "project": map[string]string{"key": "PRJ"}})
+		case "/rest/api/1.0/projects/PRJ/webhooks":
+			body = page()
+		case "/rest/api/1.0/projects/PRJ/repos/app/webhooks":
+			body = page(
+				map[string]interface{}{"id": 5, "url": "https://ci.example.com/hook", "events": []string{"repo:refs_changed", "pr:opened"}, "active": true, "sslVerificationRequired": false},
+				map[string]interface{}{"id": 6, "url": "https://old.example.com/hook", "events": []string{"pr:merged"}, "active": false},
+			)
+		case "/rest/api/1.0/projects/PRJ/repos/app/webhooks/5/statistics":
+			body = map[string]interface{}{
+				"counts":      map[string]int{"successes": successes, "failures": 2, "errors": 1},
+				"lastSuccess": map[string]interface{}{"finish": 1714644000000},
+			}
+		case "/rest/api/1.0/projects/PRJ/repos/app/webhooks/5/latest":
+			body = map[string]interface{}{"event": "repo:refs_changed", "duration": 1500, "finish": 1714644000000}
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+	client := NewBitbucketClient(&Config{BitbucketURL: ts.URL}, false)
+	c := NewWebhookInventoryCollector(client, "info")
+
+	scrape(t, c)
+	// Deliveries age out of Bitbucket's window, so the count can drop.
+	successes = 30
+	client.repoCache = nil
+	out := scrape(t, c)
+	for _, want := range []string{
+		`bitbucket_webhooks_total{project_key="PRJ",repo_slug="app",scope="repository",status="active"} 1`,
+		`bitbucket_webhooks_total{project_key="PRJ",repo_slug="app",scope="repository",status="inactive"} 1`,
+		`bitbucket_webhooks_total{project_key="PRJ",repo_slug="",scope="project",status="active"} 0`,
+		`bitbucket_webhook_info{active="true",events="pr:opened,repo:refs_changed",project_key="PRJ",repo_slug="app",scope="repository",skip_cert_verification="true",url_host="ci.example.com",webhook_id="5"} 1`,
+		"# TYPE bitbucket_webhook_window_deliveries gauge",
+		`bitbucket_webhook_window_deliveries{outcome="success",project_key="PRJ",repo_slug="app",scope="repository",webhook_id="5"} 30`,
+		`bitbucket_webhook_window_failures{endpoint="ci.example.com",project_key="PRJ",repo_slug="app",scope="repository",webhook_id="5"} 3`,
+		`bitbucket_webhook_last_success_timestamp{project_key="PRJ",repo_slug="app",scope="repository",webhook_id="5"} 1.714644e+09`,
+		// The latest invocation is sampled once, not on every scrape.
+		`bitbucket_webhook_delivery_duration_seconds_count{event_type="repo:refs_changed",project_key="PRJ",repo_slug="app",scope="repository"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+}
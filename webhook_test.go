@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postWebhook(r *WebhookReceiver, event, body, signature string) int {
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	req.Header.Set("X-Event-Key", event)
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature", signature)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookReceiver_RejectsBadSignature(t *testing.T) {
+	r := NewWebhookReceiver("s3cret", "info", nil)
+	body := `{"repository":{"full_name":"ws/app","project":{"key":"PRJ"}}}`
+	if code := postWebhook(r, "repo:push", body, ""); code != http.StatusUnauthorized {
+		t.Errorf("unsigned delivery: got %d, want 401", code)
+	}
+	if code := postWebhook(r, "repo:push", body, sign("wrong", body)); code != http.StatusUnauthorized {
+		t.Errorf("badly signed delivery: got %d, want 401", code)
+	}
+	if !strings.Contains(scrape(t, r), "bitbucket_webhook_invalid_signatures_total 2") {
+		t.Errorf("invalid signatures not counted")
+	}
+}
+
+func TestWebhookReceiver_CountsEvents(t *testing.T) {
+	r := NewWebhookReceiver("s3cret", "info", nil)
+	push := `{"repository":{"full_name":"ws/app","project":{"key":"PRJ"}},"push":{"changes":[{"forced":true,"commits":[{},{},{}]}]}}`
+	if code := postWebhook(r, "repo:push", push, sign("s3cret", push)); code != http.StatusOK {
+		t.Fatalf("push delivery: got %d, want 200", code)
+	}
+	merged := `{"repository":{"full_name":"ws/app","project":{"key":"PRJ"}},"pullrequest":{"id":4,"state":"MERGED"}}`
+	if code := postWebhook(r, "pullrequest:fulfilled", merged, sign("s3cret", merged)); code != http.StatusOK {
+		t.Fatalf("merge delivery: got %d, want 200", code)
+	}
+
+	out := scrape(t, r)
+	for _, want := range []string{
+		`bitbucket_pushes_total{project_key="PRJ",repo_slug="app"} 1`,
+		`bitbucket_commits_pushed_total{project_key="PRJ",repo_slug="app"} 3`,
+		`bitbucket_force_pushes_total{project_key="PRJ",repo_slug="app"} 1`,
+		`bitbucket_pull_request_events_total{action="merged",project_key="PRJ",repo_slug="app"} 1`,
+		`bitbucket_pull_requests_merged_total 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q", want)
+		}
+	}
+}
+
+func TestWebhookReceiver_DataCenterPullRequest(t *testing.T) {
+	var refreshed []string
+	r := NewWebhookReceiver("", "info", func(projectKey, slug string) {
+		refreshed = append(refreshed, projectKey+"/"+slug)
+	})
+	// A Data Center pr:opened payload: the repository is only under the refs.
+	opened := `{
+		"eventKey": "pr:opened",
+		"date": "2024-05-01T10:00:00+0000",
+		"actor": {"name": "alice", "slug": "alice"},
+		"pullRequest": {
+			"id": 12,
+			"title": "Add feature",
+			"state": "OPEN",
+			"fromRef": {
+				"id": "refs/heads/feature",
+				"displayId": "feature",
+				"latestCommit": "abc123",
+				"repository": {"slug": "app-fork", "id": 9, "name": "app-fork", "project": {"key": "~ALICE"}}
+			},
+			"toRef": {
+				"id": "refs/heads/master",
+				"displayId": "master",
+				"latestCommit": "def456",
+				"repository": {"slug": "app", "id": 1, "name": "app", "project": {"key": "PRJ"}}
+			}
+		}
+	}`
+	if code := postWebhook(r, "pr:opened", opened, ""); code != http.StatusOK {
+		t.Fatalf("pr:opened delivery: got %d, want 200", code)
+	}
+	if out := scrape(t, r); !strings.Contains(out, `bitbucket_pull_request_events_total{action="created",project_key="PRJ",repo_slug="app"} 1`) {
+		t.Errorf("pr:opened not counted against the target repository\n%s", out)
+	}
+	if len(refreshed) != 1 || refreshed[0] != "PRJ/app" {
+		t.Errorf("refreshed %v, want [PRJ/app]", refreshed)
+	}
+}
+
+func TestWebhookReceiver_BoundsEventLabel(t *testing.T) {
+	r := NewWebhookReceiver("", "info", nil)
+	body := `{"repository":{"full_name":"ws/app","project":{"key":"PRJ"}}}`
+	for _, event := range []string{"repo:push", "made:up", "another:one"} {
+		if code := postWebhook(r, event, body, ""); code != http.StatusOK {
+			t.Fatalf("%s delivery: got %d, want 200", event, code)
+		}
+	}
+
+	out := scrape(t, r)
+	for _, want := range []string{
+		`bitbucket_webhook_events_total{event="repo:push"} 1`,
+		`bitbucket_webhook_events_total{event="other"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "made:up") {
+		t.Errorf("unhandled event key used as a label\n%s", out)
+	}
+}